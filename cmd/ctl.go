@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl [flags] MOUNTPOINT COMMAND [ARGS]",
+	Short: "Control a mounted filesystem.",
+	Long: `Send a command to the control socket of a mounted filesystem:
+
+  status                 show who mounted it and since when
+  umount                 unmount it and stop the daemon
+  share PATH USERNAME [--ro|--rw]
+                         share a directory or a file with a user, or group:NAME
+  unshare PATH USERNAME [--rotate]
+                         stop sharing a directory or a file with a user, or group:NAME
+  shares [--incoming]    list what the user shares, or what is shared with it
+  lock                   refuse any access until it is unlocked
+  unlock                 allow the access again, after asking the password`,
+	Args:    cobra.MinimumNArgs(2),
+	Example: "netsecfs ctl /tmp/nsfs share /tmp/nsfs/docs bob",
+	RunE:    cli.Ctl,
+}
+
+func init() {
+	// the arguments after the mount point belong to the command sent
+	ctlCmd.Flags().SetInterspersed(false)
+	ctlCmd.Flags().String("socket", "", "Path of the control socket, if not the default one of the mount point.")
+	addPasswordFlags(ctlCmd)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+// groupCmd groups the commands managing the groups directories and files can be shared with
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Manage the groups of users directories and files can be shared with, as group:NAME.",
+}
+
+var groupCreateCmd = &cobra.Command{
+	Use:     "create [flags] GROUP",
+	Short:   "Create a group, owned by the user and with it as first member.",
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs group create --meta /path/to/meta.db --user alice backend",
+	RunE:    cli.GroupCreate,
+}
+
+var groupAddCmd = &cobra.Command{
+	Use:     "add [flags] GROUP USERNAME",
+	Short:   "Add a user to a group owned by the user.",
+	Args:    cobra.ExactArgs(2),
+	Example: "netsecfs group add --meta /path/to/meta.db --user alice backend bob",
+	RunE:    cli.GroupAdd,
+}
+
+var groupRmCmd = &cobra.Command{
+	Use:     "rm [flags] GROUP USERNAME",
+	Short:   "Remove a user from a group owned by the user.",
+	Args:    cobra.ExactArgs(2),
+	Example: "netsecfs group rm --meta /path/to/meta.db --user alice backend bob",
+	RunE:    cli.GroupRm,
+}
+
+var groupLsCmd = &cobra.Command{
+	Use:     "ls [flags] GROUP",
+	Short:   "List the members of a group.",
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs group ls --meta /path/to/meta.db --user alice backend",
+	RunE:    cli.GroupLs,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{groupCreateCmd, groupAddCmd, groupRmCmd, groupLsCmd} {
+		c.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
+		c.Flags().StringP("user", "u", "", "Name of the user.")
+		c.MarkFlagRequired("meta")
+		c.MarkFlagRequired("user")
+		addPasswordFlags(c)
+		groupCmd.AddCommand(c)
+	}
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
@@ -37,7 +38,7 @@ func initialize(cmd *cobra.Command, args []string) {
 		logger.Fatalf("invalid name: %s, only alphabet, number and - are allowed, and the length should be 3 to 63 characters.", name)
 	}
 
-	m := meta.RegisterMeta(addr)
+	m := meta.RegisterMeta(addr, false)
 
 	format := &meta.Format{
 		Name:    name,
@@ -46,13 +47,25 @@ func initialize(cmd *cobra.Command, args []string) {
 		// Capacity:  utils.ParseBytes(c, "capacity", 'G'),
 		BlockSize: BlockSize,
 	}
-	p, err := filepath.Abs(format.Storage)
-	if err != nil {
-		logger.Fatalf("Failed to get absolute path of %s: %s", format.Storage, err)
+	if dir, ok := strings.CutPrefix(format.Storage, "file://"); ok {
+		p, err := filepath.Abs(dir)
+		if err != nil {
+			logger.Fatalf("Failed to get absolute path of %s: %s", dir, err)
+		}
+		format.Storage = "file://" + p
+	} else if !strings.Contains(format.Storage, "://") {
+		p, err := filepath.Abs(format.Storage)
+		if err != nil {
+			logger.Fatalf("Failed to get absolute path of %s: %s", format.Storage, err)
+		}
+		format.Storage = p
+	} else if stripped := utils.StripUserinfo(format.Storage); stripped != format.Storage {
+		// the volume is readable by all its users, the credentials of the storage are not saved
+		logger.Warnf("The credentials of the storage are not saved, give them to the clients with NETSECFS_STORAGE_USER and NETSECFS_STORAGE_PASSWORD")
+		format.Storage = stripped
 	}
-	format.Storage = p
 
-	blob, err := object.CreateStorage(storage)
+	blob, err := object.CreateStorage(storage, false)
 	logger.Infof("Data use %s", blob)
 	if err != nil {
 		panic(err)
@@ -65,8 +78,8 @@ func initialize(cmd *cobra.Command, args []string) {
 }
 
 func init() {
-	initCmd.Flags().StringP("storage", "s", "", "Path to the storage database.")
-	initCmd.Flags().StringP("meta", "m", "", "Path to the meta database.")
+	initCmd.Flags().StringP("storage", "s", "", "Path or URL of the storage (database, file:// or s3://).")
+	initCmd.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
 	initCmd.MarkFlagRequired("storage")
 	initCmd.MarkFlagRequired("meta")
 }
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var mountCmd = &cobra.Command{
+	Use:   "mount [flags] [MOUNTPOINT]",
+	Short: "Mount the filesystem as a user.",
+	Long: `Mount the filesystem as a user without the interactive console.
+It is served until it is unmounted or the process is interrupted.
+
+The options of FUSE can be given in a YAML or JSON file with --config,
+where root_path is the mount point if not given as argument, and are
+overridden by the flags.
+
+With --daemon, it keeps running in the background after the password
+was given. The mounted filesystem can be controlled with the ctl command.`,
+	Args:    cobra.MaximumNArgs(1),
+	Example: "netsecfs mount --meta /path/to/meta.db --user alice --env-file /etc/netsecfs/alice.env /tmp/nsfs",
+	RunE:    cli.Mount,
+}
+
+func init() {
+	mountCmd.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
+	mountCmd.Flags().StringP("user", "u", "", "Name of the user.")
+	mountCmd.Flags().StringP("config", "c", "", "YAML or JSON file configuring the mount.")
+	mountCmd.Flags().Int("entry-timeout", 1, "Seconds the kernel caches the entries of directories.")
+	mountCmd.Flags().Int("attr-timeout", 1, "Seconds the kernel caches the attributes of files.")
+	mountCmd.Flags().Int("negative-timeout", 1, "Seconds the kernel caches missing entries.")
+	mountCmd.Flags().Bool("allow-other", false, "Allow the other users to access the filesystem.")
+	mountCmd.Flags().Int("max-readahead", 0, "Maximum bytes read ahead by the kernel (default of FUSE if 0).")
+	mountCmd.Flags().Int("max-write", 0, "Maximum bytes of a write request (default of FUSE if 0).")
+	mountCmd.Flags().Bool("debug", false, "Log every FUSE operation.")
+	mountCmd.Flags().Bool("read-only", false, "Mount read-only, the volume cannot be changed in any way.")
+	mountCmd.Flags().BoolP("daemon", "d", false, "Run in the background.")
+	mountCmd.Flags().String("pidfile", "", "File to write the pid of the daemon to (default in $XDG_RUNTIME_DIR or /tmp).")
+	mountCmd.Flags().String("socket", "", "Path of the control socket (default in $XDG_RUNTIME_DIR or /tmp).")
+	mountCmd.Flags().String("log", "", "File to write the logs of the daemon to.")
+	mountCmd.MarkFlagRequired("meta")
+	mountCmd.MarkFlagRequired("user")
+	addPasswordFlags(mountCmd)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd [flags]",
+	Short: "Change the password of a user.",
+	Long: `Change the password of a user. The current and the new passwords are
+asked on the terminal, or read from --password-fd (one per line) or from the
+NETSECFS_PASSWORD and NETSECFS_NEW_PASSWORD variables of --env-file.`,
+	Args:    cobra.NoArgs,
+	Example: "netsecfs passwd --meta /path/to/meta.db --user alice",
+	RunE:    cli.Passwd,
+}
+
+func init() {
+	passwdCmd.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
+	passwdCmd.Flags().StringP("user", "u", "", "Name of the user.")
+	passwdCmd.MarkFlagRequired("meta")
+	passwdCmd.MarkFlagRequired("user")
+	addPasswordFlags(passwdCmd)
+}
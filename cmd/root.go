@@ -4,7 +4,10 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/bastienvty/netsecfs/internal/cli"
 	"github.com/spf13/cobra"
@@ -30,11 +33,23 @@ init command before mounting it.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		cli.Initialize(cmd, args)
 	},
+	// the arguments and flags are checked by then, the usage would hide the error
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	// mount(8) runs /sbin/mount.netsecfs, or mount.fuse.netsecfs, for the entries of fstab
+	if strings.HasPrefix(filepath.Base(os.Args[0]), "mount.") {
+		if err := cli.MountHelper(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	err := rootCmd.Execute()
 	if err != nil {
 		os.Exit(1)
@@ -44,8 +59,15 @@ func Execute() {
 func init() {
 	rootCmd.Flags().BoolP("version", "v", false, "Print the version number of netsecfs")
 
-	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(initCmd, userCmd, passwdCmd, mountCmd, shareCmd, groupCmd, ctlCmd)
 
-	rootCmd.Flags().StringP("meta", "m", "", "Path to the meta database.")
+	rootCmd.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
 	rootCmd.MarkFlagRequired("meta")
 }
+
+// addPasswordFlags adds the flags giving the passwords to a non-interactive command.
+func addPasswordFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("password-fd", -1, "File descriptor to read the passwords from, one per line.")
+	cmd.Flags().String("env-file", "", "File defining NETSECFS_PASSWORD (and NETSECFS_NEW_PASSWORD for passwd).")
+	cmd.MarkFlagsMutuallyExclusive("password-fd", "env-file")
+}
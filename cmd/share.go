@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+// shareCmd groups the commands sharing directories and files with other users
+var shareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Manage the directories and files shared with other users.",
+}
+
+var shareAddCmd = &cobra.Command{
+	Use:     "add [flags] PATH USERNAME",
+	Short:   "Share a directory or a file of a mounted filesystem with a user, or group:NAME, read-only with --ro.",
+	Args:    cobra.ExactArgs(2),
+	Example: "netsecfs share add --meta /path/to/meta.db --user alice /tmp/nsfs/docs bob",
+	RunE:    cli.ShareAdd,
+}
+
+var shareLsCmd = &cobra.Command{
+	Use:     "ls [flags]",
+	Short:   "List the directories and files shared by a user, or with --incoming the ones shared with it.",
+	Args:    cobra.NoArgs,
+	Example: "netsecfs share ls --meta /path/to/meta.db --user alice --incoming",
+	RunE:    cli.ShareLs,
+}
+
+var shareRmCmd = &cobra.Command{
+	Use:     "rm [flags] PATH USERNAME",
+	Short:   "Stop sharing a directory or a file of a mounted filesystem with a user, or group:NAME, and rotate its keys with --rotate.",
+	Args:    cobra.ExactArgs(2),
+	Example: "netsecfs share rm --meta /path/to/meta.db --user alice /tmp/nsfs/docs bob",
+	RunE:    cli.ShareRm,
+}
+
+func init() {
+	shareAddCmd.Flags().Bool("ro", false, "Share read-only.")
+	shareAddCmd.Flags().Bool("rw", false, "Share read-write (default).")
+	shareAddCmd.MarkFlagsMutuallyExclusive("ro", "rw")
+	shareRmCmd.Flags().Bool("rotate", false, "Encrypt it again with new keys, so that the keys the user got are useless.")
+
+	shareLsCmd.Flags().Bool("incoming", false, "List the directories and files shared with the user.")
+
+	for _, c := range []*cobra.Command{shareAddCmd, shareLsCmd, shareRmCmd} {
+		c.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
+		c.Flags().StringP("user", "u", "", "Name of the user owning the directory or file.")
+		c.MarkFlagRequired("meta")
+		c.MarkFlagRequired("user")
+		addPasswordFlags(c)
+		shareCmd.AddCommand(c)
+	}
+}
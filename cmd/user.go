@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+// userCmd groups the commands managing the users of a volume
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of the filesystem.",
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add [flags] USERNAME",
+	Short: "Create a user.",
+	Long: `Create a user with its own keys. The password is asked on the
+terminal, or read from --password-fd or --env-file.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs user add --meta /path/to/meta.db alice",
+	RunE:    cli.UserAdd,
+}
+
+func init() {
+	userAddCmd.Flags().StringP("meta", "m", "", "Path or URL of the meta database.")
+	userAddCmd.MarkFlagRequired("meta")
+	addPasswordFlags(userAddCmd)
+	userCmd.AddCommand(userAddCmd)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/bastienvty/netsecfs/internal/config"
 	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
@@ -30,28 +31,18 @@ func Initialize(cmd *cobra.Command, args []string) {
 	addr, _ := cmd.Flags().GetString("meta")
 	mp := args[0]
 
-	m := meta.RegisterMeta(addr)
-	format, err := m.Load()
+	m, format, blob, err := openVolume(addr, false)
 	if err != nil {
-		fmt.Println("Load fail: ", err)
+		fmt.Println("Open fail: ", err)
 		return
 	}
-	blob, err := object.CreateStorage(format.Storage)
-	if err != nil {
-		fmt.Println("CreateStorage fail: ", err)
-		return
-	}
-	if m != nil {
-		defer m.Shutdown()
-	}
-	if blob != nil {
-		defer object.Shutdown(blob)
-	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
 
-	startConsole(m, blob, mp)
+	startConsole(m, blob, format, mp)
 }
 
-func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
+func startConsole(m meta.Meta, blob object.ObjectStorage, format *meta.Format, mp string) {
 	scanner := bufio.NewScanner(os.Stdin)
 	var server *fuse.Server
 	var err error
@@ -74,25 +65,31 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 			}
 			return
 		case "help":
-			fmt.Println("Commands: signup, login, logout, passwd, mount, umount, share, unshare and exit")
+			fmt.Println("Commands: signup, login, logout, passwd, mount, umount, share, unshare, shares, group and exit")
 		case "signup":
 			if isLogged {
 				fmt.Println("User already logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: signup <username> <password>")
+			if len(fields) != 2 {
+				fmt.Println("Usage: signup <username>")
+				continue
+			}
+			password, err := promptPassword("Password: ", true)
+			if err != nil {
+				fmt.Println(err)
 				continue
 			}
 			user = User{
 				username: fields[1],
-				password: fields[2],
+				password: password,
 				m:        m,
 				enc:      &crypto.CryptoHelper{},
 			}
 			// startTime := time.Now()
 			create := user.createUser()
 			if !create {
+				user.wipe()
 				fmt.Println("User creation failed. Please try again.")
 				continue
 			}
@@ -105,18 +102,24 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User already logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: login <username> <password>")
+			if len(fields) != 2 {
+				fmt.Println("Usage: login <username>")
+				continue
+			}
+			password, err := promptPassword("Password: ", false)
+			if err != nil {
+				fmt.Println(err)
 				continue
 			}
 			user = User{
 				username: fields[1],
-				password: fields[2],
+				password: password,
 				m:        m,
 				enc:      &crypto.CryptoHelper{},
 			}
 			verify := user.verifyUser()
 			if !verify {
+				user.wipe()
 				fmt.Println("User verification failed. Please try again.")
 				continue
 			}
@@ -131,12 +134,18 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("Unmount before changing password.")
 				continue
 			}
-			if len(fields) != 2 {
-				fmt.Println("Usage: passwd <new_password>")
+			if len(fields) != 1 {
+				fmt.Println("Usage: passwd")
 				continue
 			}
-			changed := user.changePassword(fields[1])
+			password, err := promptPassword("New password: ", true)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			changed := user.changePassword(password)
 			if !changed {
+				clear(password)
 				fmt.Println("Password change failed. Please try again.")
 				continue
 			}
@@ -150,11 +159,12 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User not logged in.")
 				continue
 			}
-			server, err = mount(user, blob, mp)
+			server, _, err = mount(user, blob, format, &config.FUSE{RootPath: mp})
 			if err != nil || server == nil {
 				fmt.Println("Mount fail: ", err)
 				return
 			}
+			go reencryptFiles(m, blob, format.BlockSize, user.pendingRekeys())
 			isMounted = true
 		case "umount":
 			if server == nil {
@@ -166,7 +176,7 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("Unmount fail: ", err)
 				continue
 			}
-			fmt.Println("Umount successfull.")
+			fmt.Println("Umount successful.")
 			isMounted = false
 		case "share":
 			if !isMounted {
@@ -177,17 +187,22 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User not logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: share <folder_path> <user>")
+			if len(fields) != 3 && len(fields) != 4 {
+				fmt.Println("Usage: share <path> <user|group:NAME> [--ro|--rw]")
+				continue
+			}
+			option, err := shareOption(fields[3:], "--ro", "--rw")
+			if err != nil {
+				fmt.Println(err)
 				continue
 			}
 			dir := mp + "/" + fields[1]
-			shared := user.shareDir(dir, fields[2])
+			shared := user.share(dir, fields[2], option == "--ro")
 			if !shared {
 				fmt.Println("Share failed. Please try again.")
 				continue
 			}
-			fmt.Println("Share successfull.")
+			fmt.Println("Share successful.")
 		case "unshare":
 			if !isMounted {
 				fmt.Println("Mount before unsharing.")
@@ -197,17 +212,60 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User not logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: unshare <folder_path> <user>")
+			if len(fields) != 3 && len(fields) != 4 {
+				fmt.Println("Usage: unshare <path> <user|group:NAME> [--rotate]")
+				continue
+			}
+			option, err := shareOption(fields[3:], "--rotate")
+			if err != nil {
+				fmt.Println(err)
 				continue
 			}
 			dir := mp + "/" + fields[1]
-			unshared := user.unshareDir(dir, fields[2])
+			var unshared bool
+			if option == "--rotate" {
+				unshared = user.rotate(dir, fields[2], blob, format.BlockSize, false)
+			} else {
+				unshared = user.unshare(dir, fields[2])
+			}
 			if !unshared {
 				fmt.Println("Unshare failed. Please try again.")
 				continue
 			}
-			fmt.Println("Unshare successfull.")
+			fmt.Println("Unshare successful.")
+		case "shares":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			option, err := shareOption(fields[1:], "--incoming")
+			if err != nil {
+				fmt.Println("Usage: shares [--incoming]")
+				continue
+			}
+			user.listShares(os.Stdout, option == "--incoming")
+		case "group":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			var done bool
+			switch {
+			case len(fields) == 3 && fields[1] == "create":
+				done = user.createGroup(fields[2])
+			case len(fields) == 4 && fields[1] == "add":
+				done = user.addMember(fields[2], fields[3])
+			case len(fields) == 4 && fields[1] == "rm":
+				done = user.removeMember(fields[2], fields[3])
+			case len(fields) == 3 && fields[1] == "ls":
+				done = user.listMembers(os.Stdout, fields[2])
+			default:
+				fmt.Println("Usage: group create <group> | group add <group> <user> | group rm <group> <user> | group ls <group>")
+				continue
+			}
+			if !done {
+				fmt.Println("Group command failed. Please try again.")
+			}
 		case "logout":
 			if !isLogged {
 				fmt.Println("User not logged in.")
@@ -219,6 +277,7 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 			}
 			fmt.Printf("User %s logged out.\n", user.username)
 			isLogged = false
+			user.wipe()
 			user = User{}
 		}
 	}
@@ -0,0 +1,443 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bastienvty/netsecfs/internal/config"
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/spf13/cobra"
+)
+
+// openVolume loads the format of the volume and opens its storage, without
+// allowing any change when readOnly.
+func openVolume(addr string, readOnly bool) (meta.Meta, *meta.Format, object.ObjectStorage, error) {
+	m := meta.RegisterMeta(addr, readOnly)
+	format, err := m.Load()
+	if err != nil {
+		m.Shutdown()
+		return nil, nil, nil, fmt.Errorf("load: %s", err)
+	}
+	blob, err := object.CreateStorage(format.Storage, readOnly)
+	if err != nil {
+		m.Shutdown()
+		return nil, nil, nil, fmt.Errorf("create storage: %s", err)
+	}
+	return m, format, blob, nil
+}
+
+// login returns the user named username, verified with its password.
+func login(m meta.Meta, username string, pwd *passwordSource) (*User, error) {
+	password, err := pwd.read("Password: ", envPassword, false)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{
+		username: username,
+		password: password,
+		m:        m,
+		enc:      &crypto.CryptoHelper{},
+	}
+	if !user.verifyUser() {
+		user.wipe()
+		return nil, fmt.Errorf("verification of user %s failed", username)
+	}
+	// as for a mount, what the user changes or shares is its own, or shared with it
+	var userId uint32
+	if err = m.GetUserId(username, &userId); err != nil {
+		user.wipe()
+		return nil, err
+	}
+	m.SetUser(userId)
+	return user, nil
+}
+
+// UserAdd creates the user named by the first argument.
+func UserAdd(cmd *cobra.Command, args []string) error {
+	addr, _ := cmd.Flags().GetString("meta")
+	m, _, blob, err := openVolume(addr, false)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	password, err := newPasswordSource(cmd).read("Password: ", envPassword, true)
+	if err != nil {
+		return err
+	}
+	user := User{
+		username: args[0],
+		password: password,
+		m:        m,
+		enc:      &crypto.CryptoHelper{},
+	}
+	defer user.wipe()
+	if !user.createUser() {
+		return fmt.Errorf("creation of user %s failed", user.username)
+	}
+	fmt.Printf("User %s created.\n", user.username)
+	return nil
+}
+
+// Passwd changes the password of the user named by the --user flag.
+func Passwd(cmd *cobra.Command, args []string) error {
+	addr, _ := cmd.Flags().GetString("meta")
+	m, _, blob, err := openVolume(addr, false)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	username, _ := cmd.Flags().GetString("user")
+	pwd := newPasswordSource(cmd)
+	user, err := login(m, username, pwd)
+	if err != nil {
+		return err
+	}
+	defer user.wipe()
+	password, err := pwd.read("New password: ", envNewPassword, true)
+	if err != nil {
+		return err
+	}
+	if !user.changePassword(password) {
+		clear(password)
+		return fmt.Errorf("password change of user %s failed", user.username)
+	}
+	fmt.Println("Password changed successfully.")
+	return nil
+}
+
+// mountArgs describes how to mount a volume, from the flags of the mount
+// command or the options of mount.netsecfs.
+type mountArgs struct {
+	meta     string
+	user     string
+	fuse     *config.FUSE
+	readOnly bool
+	daemon   bool
+	socket   string
+	pidfile  string
+	logFile  string
+	password *passwordSource
+}
+
+// Mount mounts the volume at the mount point given as first argument, or by the
+// configuration file, and serves it until it is unmounted, in the background with --daemon.
+func Mount(cmd *cobra.Command, args []string) error {
+	a := &mountArgs{fuse: &config.FUSE{}, password: newPasswordSource(cmd)}
+	if path, _ := cmd.Flags().GetString("config"); path != "" {
+		conf, err := config.Load(path)
+		if err != nil {
+			return err
+		}
+		a.fuse = conf
+	}
+	if len(args) > 0 {
+		a.fuse.RootPath = args[0]
+	}
+	setFUSEFlags(cmd, a.fuse)
+	a.meta, _ = cmd.Flags().GetString("meta")
+	a.user, _ = cmd.Flags().GetString("user")
+	a.readOnly, _ = cmd.Flags().GetBool("read-only")
+	a.daemon, _ = cmd.Flags().GetBool("daemon")
+	a.socket, _ = cmd.Flags().GetString("socket")
+	a.pidfile, _ = cmd.Flags().GetString("pidfile")
+	a.logFile, _ = cmd.Flags().GetString("log")
+	return runMount(a)
+}
+
+// setFUSEFlags overrides the configuration with the flags given to the command.
+func setFUSEFlags(cmd *cobra.Command, conf *config.FUSE) {
+	flags := cmd.Flags()
+	for name, t := range map[string]**int{
+		"entry-timeout":    &conf.EntryTimeout,
+		"attr-timeout":     &conf.AttrTimeout,
+		"negative-timeout": &conf.NegativeTimeout,
+	} {
+		if flags.Changed(name) {
+			v, _ := flags.GetInt(name)
+			*t = &v
+		}
+	}
+	if flags.Changed("allow-other") {
+		conf.AllowOther, _ = flags.GetBool("allow-other")
+	}
+	if flags.Changed("max-readahead") {
+		conf.MaxReadAhead, _ = flags.GetInt("max-readahead")
+	}
+	if flags.Changed("max-write") {
+		conf.MaxWrite, _ = flags.GetInt("max-write")
+	}
+	if flags.Changed("debug") {
+		conf.Debug, _ = flags.GetBool("debug")
+	}
+}
+
+func runMount(a *mountArgs) error {
+	if a.fuse.RootPath == "" {
+		return errors.New("no mount point, give it as argument or root_path in the configuration")
+	}
+	mp, err := filepath.Abs(a.fuse.RootPath)
+	if err != nil {
+		return err
+	}
+	a.fuse.RootPath = mp
+	if a.readOnly {
+		a.fuse.MountOptions = append(a.fuse.MountOptions, "ro")
+	}
+	if err = a.fuse.Check(); err != nil {
+		return err
+	}
+	socket, pidfile := controlPaths(mp)
+	if a.socket != "" {
+		socket = a.socket
+	}
+	if a.pidfile != "" {
+		pidfile = a.pidfile
+	}
+	inDaemon := os.Getenv(envDaemon) != ""
+	pwd := a.password
+	if a.daemon && !inDaemon {
+		password, err := pwd.read("Password: ", envPassword, false)
+		if err != nil {
+			return err
+		}
+		err = daemonize(password, a.logFile)
+		clear(password)
+		return err
+	}
+	// the process waiting in daemonize is told why the mount failed
+	check := func(err error) error {
+		if inDaemon {
+			daemonReady(err)
+		}
+		return err
+	}
+	if inDaemon {
+		pwd = &passwordSource{fd: daemonPasswordFd}
+	}
+
+	m, format, blob, err := openVolume(a.meta, a.readOnly)
+	if err != nil {
+		return check(err)
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	user, err := login(m, a.user, pwd)
+	if err != nil {
+		return check(err)
+	}
+	defer user.wipe()
+	server, root, err := mount(*user, blob, format, a.fuse)
+	if err != nil {
+		return check(err)
+	}
+	if !a.readOnly {
+		go reencryptFiles(m, blob, format.BlockSize, user.pendingRekeys())
+	}
+	c := &controller{user: user, server: server, root: root, blob: blob, blockSize: format.BlockSize, mp: mp, started: time.Now()}
+	l, err := c.serve(socket)
+	if err != nil {
+		server.Unmount()
+		return check(fmt.Errorf("control socket: %s", err))
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+	if inDaemon {
+		if err = writePidfile(pidfile); err != nil {
+			server.Unmount()
+			return check(fmt.Errorf("pidfile: %s", err))
+		}
+		defer os.Remove(pidfile)
+		daemonReady(nil)
+	}
+	server.Wait()
+	return nil
+}
+
+// Ctl sends the command given after the mount point to the control socket of a mounted volume.
+func Ctl(cmd *cobra.Command, args []string) error {
+	mp, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	socket, _ := cmd.Flags().GetString("socket")
+	if socket == "" {
+		socket, _ = controlPaths(mp)
+	}
+	req := &controlRequest{Command: args[1], Args: args[2:]}
+	switch req.Command {
+	case "share", "unshare":
+		if len(req.Args) > 0 {
+			req.Args[0], err = filepath.Abs(req.Args[0])
+			if err != nil {
+				return err
+			}
+		}
+	case "unlock":
+		req.Password, err = newPasswordSource(cmd).read("Password: ", envPassword, false)
+		if err != nil {
+			return err
+		}
+	}
+	msg, err := sendControl(socket, req)
+	clear(req.Password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+// ShareAdd shares the directory or file given as first argument, inside a mounted volume,
+// with the user given as second argument.
+func ShareAdd(cmd *cobra.Command, args []string) error {
+	readOnly, _ := cmd.Flags().GetBool("ro")
+	share := func(u *User, blob object.ObjectStorage, format *meta.Format, path, username string) bool {
+		return u.share(path, username, readOnly)
+	}
+	return shareCommand(cmd, args, share, "Share")
+}
+
+// ShareRm stops sharing the directory or file given as first argument with the user given as second argument,
+// and with --rotate encrypts it with new keys.
+func ShareRm(cmd *cobra.Command, args []string) error {
+	rotate, _ := cmd.Flags().GetBool("rotate")
+	unshare := func(u *User, blob object.ObjectStorage, format *meta.Format, path, username string) bool {
+		if rotate {
+			return u.rotate(path, username, blob, format.BlockSize, true)
+		}
+		return u.unshare(path, username)
+	}
+	return shareCommand(cmd, args, unshare, "Unshare")
+}
+
+// shareOption returns the optional argument after the path and user of share or unshare,
+// one of allowed.
+func shareOption(args []string, allowed ...string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if len(args) == 1 && slices.Contains(allowed, args[0]) {
+		return args[0], nil
+	}
+	return "", fmt.Errorf("unexpected %s, expected %s", strings.Join(args, " "), strings.Join(allowed, " or "))
+}
+
+// ShareLs lists the directories and files the user shares, or with --incoming the ones shared with it.
+func ShareLs(cmd *cobra.Command, args []string) error {
+	addr, _ := cmd.Flags().GetString("meta")
+	m, _, blob, err := openVolume(addr, true)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	username, _ := cmd.Flags().GetString("user")
+	user, err := login(m, username, newPasswordSource(cmd))
+	if err != nil {
+		return err
+	}
+	defer user.wipe()
+	incoming, _ := cmd.Flags().GetBool("incoming")
+	if !user.listShares(os.Stdout, incoming) {
+		return errors.New("listing the shares failed")
+	}
+	return nil
+}
+
+func shareCommand(cmd *cobra.Command, args []string, do func(*User, object.ObjectStorage, *meta.Format, string, string) bool, what string) error {
+	addr, _ := cmd.Flags().GetString("meta")
+	m, format, blob, err := openVolume(addr, false)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	username, _ := cmd.Flags().GetString("user")
+	user, err := login(m, username, newPasswordSource(cmd))
+	if err != nil {
+		return err
+	}
+	defer user.wipe()
+	if !do(user, blob, format, dir, args[1]) {
+		return fmt.Errorf("%s failed", what)
+	}
+	fmt.Printf("%s successful.\n", what)
+	return nil
+}
+
+// GroupCreate creates the group given as first argument, owned by the user.
+func GroupCreate(cmd *cobra.Command, args []string) error {
+	return groupCommand(cmd, func(u *User) bool { return u.createGroup(args[0]) }, "Group creation")
+}
+
+// GroupAdd adds the user given as second argument to the group given as first argument.
+func GroupAdd(cmd *cobra.Command, args []string) error {
+	return groupCommand(cmd, func(u *User) bool { return u.addMember(args[0], args[1]) }, "Member addition")
+}
+
+// GroupRm removes the user given as second argument from the group given as first argument.
+func GroupRm(cmd *cobra.Command, args []string) error {
+	return groupCommand(cmd, func(u *User) bool { return u.removeMember(args[0], args[1]) }, "Member removal")
+}
+
+// GroupLs lists the members of the group given as first argument.
+func GroupLs(cmd *cobra.Command, args []string) error {
+	addr, _ := cmd.Flags().GetString("meta")
+	m, _, blob, err := openVolume(addr, true)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	username, _ := cmd.Flags().GetString("user")
+	user, err := login(m, username, newPasswordSource(cmd))
+	if err != nil {
+		return err
+	}
+	defer user.wipe()
+	if !user.listMembers(os.Stdout, args[0]) {
+		return errors.New("listing the members failed")
+	}
+	return nil
+}
+
+func groupCommand(cmd *cobra.Command, do func(*User) bool, what string) error {
+	addr, _ := cmd.Flags().GetString("meta")
+	m, _, blob, err := openVolume(addr, false)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	defer object.Shutdown(blob)
+
+	username, _ := cmd.Flags().GetString("user")
+	user, err := login(m, username, newPasswordSource(cmd))
+	if err != nil {
+		return err
+	}
+	defer user.wipe()
+	if !do(user) {
+		return fmt.Errorf("%s failed", what)
+	}
+	fmt.Printf("%s successful.\n", what)
+	return nil
+}
@@ -0,0 +1,294 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/internal/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// envDaemon is set in the environment of the background process of `mount -d`
+	envDaemon = "NETSECFS_DAEMON"
+	// the background process gets the password and reports its mount on these descriptors
+	daemonPasswordFd = 3
+	daemonReadyFd    = 4
+)
+
+// controlPaths returns the default control socket and pidfile of the volume mounted at mp.
+func controlPaths(mp string) (socket, pidfile string) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(mp))
+	name := fmt.Sprintf("netsecfs-%x", h.Sum64())
+	return filepath.Join(dir, name+".sock"), filepath.Join(dir, name+".pid")
+}
+
+// daemonize starts the same command in a new session and waits until it has mounted the volume.
+func daemonize(password []byte, logFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	pwdR, pwdW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if logFile != "" {
+		out, err = os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Args[0] = os.Args[0] // as mount.netsecfs, it is recognised by its name
+	child.Env = append(os.Environ(), envDaemon+"=1")
+	child.Stdout = out
+	child.Stderr = out
+	child.ExtraFiles = []*os.File{pwdR, readyW} // daemonPasswordFd and daemonReadyFd
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = child.Start(); err != nil {
+		return err
+	}
+	pwdR.Close()
+	readyW.Close()
+	// the password goes through a pipe, it never appears in the arguments or the environment
+	_, err = pwdW.Write(append(password, '\n'))
+	pwdW.Close()
+	if err != nil {
+		return err
+	}
+	msg, _ := io.ReadAll(readyR)
+	readyR.Close()
+	if string(msg) != "ok" {
+		if len(msg) == 0 {
+			msg = []byte("the daemon exited before mounting the volume")
+		}
+		return errors.New(string(msg))
+	}
+	fmt.Printf("Mounted in the background, pid %d.\n", child.Process.Pid)
+	return child.Process.Release()
+}
+
+// daemonReady reports the result of the mount to the process waiting in daemonize.
+func daemonReady(err error) {
+	ready := os.NewFile(daemonReadyFd, "ready")
+	if ready == nil {
+		return
+	}
+	if err != nil {
+		ready.Write([]byte(err.Error()))
+	} else {
+		ready.Write([]byte("ok"))
+	}
+	ready.Close()
+}
+
+func writePidfile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+type controlRequest struct {
+	Command  string
+	Args     []string `json:",omitempty"`
+	Password []byte   `json:",omitempty"`
+}
+
+type controlResponse struct {
+	Ok      bool
+	Message string
+}
+
+// controller answers the requests sent to the control socket of a mounted volume.
+type controller struct {
+	user   *User
+	server *fuse.Server
+	root   *fs.Node
+	// the storage where the blocks are re-encrypted after a rotation of the keys
+	blob      object.ObjectStorage
+	blockSize int
+	mp        string
+	started   time.Time
+	locked    bool
+}
+
+// serve listens on the control socket until the volume is unmounted.
+func (c *controller) serve(socket string) (net.Listener, error) {
+	_ = os.Remove(socket) // left by a process that was killed
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.handle(conn)
+		}
+	}()
+	return l, nil
+}
+
+func (c *controller) handle(conn net.Conn) {
+	defer conn.Close()
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		return
+	}
+	msg, err := c.do(&req)
+	clear(req.Password)
+	resp := controlResponse{Ok: err == nil, Message: msg}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	_ = json.NewEncoder(conn).Encode(&resp)
+	if req.Command == "umount" && err == nil {
+		// answered first: the process exits as soon as the volume is unmounted
+		if err = c.server.Unmount(); err != nil {
+			fmt.Println("Unmount fail: ", err)
+		}
+	}
+}
+
+func (c *controller) do(req *controlRequest) (string, error) {
+	switch req.Command {
+	case "status":
+		state := "unlocked"
+		if c.locked {
+			state = "locked"
+		}
+		return fmt.Sprintf("mounted at %s as %s, pid %d, since %s, %s",
+			c.mp, c.user.username, os.Getpid(), c.started.Format(time.RFC3339), state), nil
+	case "umount":
+		return "unmounting", nil
+	case "share", "unshare":
+		if len(req.Args) < 2 {
+			return "", fmt.Errorf("usage: %s <path> <user|group:NAME>", req.Command)
+		}
+		allowed := []string{"--ro", "--rw"}
+		if req.Command == "unshare" {
+			allowed = []string{"--rotate"}
+		}
+		option, err := shareOption(req.Args[2:], allowed...)
+		if err != nil {
+			return "", err
+		}
+		if c.locked {
+			return "", errors.New("the volume is locked")
+		}
+		if !strings.HasPrefix(req.Args[0], c.mp+"/") {
+			return "", fmt.Errorf("%s is not in %s", req.Args[0], c.mp)
+		}
+		var ok bool
+		switch {
+		case req.Command == "share":
+			ok = c.user.share(req.Args[0], req.Args[1], option == "--ro")
+		case option == "--rotate":
+			ok = c.user.rotate(req.Args[0], req.Args[1], c.blob, c.blockSize, false)
+			if ok {
+				// the nodes looked up before keep their keys until they are looked up again
+				c.root.InvalidateEntry(strings.TrimPrefix(req.Args[0], c.mp+"/"))
+			}
+		default:
+			ok = c.user.unshare(req.Args[0], req.Args[1])
+		}
+		if !ok {
+			return "", fmt.Errorf("%s failed", req.Command)
+		}
+		return req.Command + " successful", nil
+	case "shares":
+		option, err := shareOption(req.Args, "--incoming")
+		if err != nil {
+			return "", err
+		}
+		if c.locked {
+			return "", errors.New("the volume is locked")
+		}
+		var b strings.Builder
+		if !c.user.listShares(&b, option == "--incoming") {
+			return "", errors.New("listing the shares failed")
+		}
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	case "lock":
+		c.root.SetLocked(true)
+		c.locked = true
+		// the password can be asked again to unlock
+		clear(c.user.password)
+		clear(c.user.masterKey)
+		c.user.password = nil
+		c.user.masterKey = nil
+		return "locked", nil
+	case "unlock":
+		if !c.locked {
+			return "not locked", nil
+		}
+		u := User{
+			username: c.user.username,
+			password: req.Password,
+			m:        c.user.m,
+			enc:      &crypto.CryptoHelper{},
+		}
+		ok := u.verifyUser()
+		u.password = nil // cleared with the request
+		u.wipe()
+		if !ok {
+			return "", errors.New("verification failed")
+		}
+		c.root.SetLocked(false)
+		c.locked = false
+		return "unlocked", nil
+	default:
+		return "", fmt.Errorf("unknown command %q", req.Command)
+	}
+}
+
+// sendControl sends a request to the control socket and returns the answer.
+func sendControl(socket string, req *controlRequest) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", fmt.Errorf("connect to %s: %s", socket, err)
+	}
+	defer conn.Close()
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return "", err
+	}
+	var resp controlResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", err
+	}
+	if !resp.Ok {
+		return "", errors.New(resp.Message)
+	}
+	return resp.Message, nil
+}
@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bastienvty/netsecfs/internal/config"
+)
+
+// MountHelper mounts a volume as mount.netsecfs, when called by mount(8) with
+// `SOURCE MOUNTPOINT [-o OPTIONS]` for an entry of fstab. The source is the meta
+// database, unless given by the meta option, and the volume is served in the background.
+func MountHelper(args []string) error {
+	var positional, options []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" && i+1 < len(args):
+			i++
+			options = append(options, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(arg, "-o"):
+			options = append(options, strings.Split(arg[2:], ",")...)
+		case arg == "-t" || arg == "-N":
+			i++ // the type or namespace given by mount(8)
+		case strings.HasPrefix(arg, "-"):
+			// -n, -s, -f and -v have no effect
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: mount.netsecfs META MOUNTPOINT [-o user=NAME,keyfile=PATH,...]")
+	}
+	a := &mountArgs{meta: positional[0], fuse: &config.FUSE{}, daemon: true, password: &passwordSource{fd: -1}}
+	// the configuration file is read first, the other options override it
+	for _, o := range options {
+		if path, ok := strings.CutPrefix(o, "config="); ok {
+			conf, err := config.Load(path)
+			if err != nil {
+				return err
+			}
+			a.fuse = conf
+		}
+	}
+	a.fuse.RootPath = positional[1]
+	var keyfile string
+	for _, o := range options {
+		key, value, _ := strings.Cut(o, "=")
+		var err error
+		switch key {
+		case "config":
+		case "meta":
+			a.meta = value
+		case "user":
+			// without a value, it is the option of mount(8) letting any user mount the entry
+			if value != "" {
+				a.user = value
+			}
+		case "ro", "rw":
+			a.readOnly = key == "ro"
+		case "keyfile":
+			keyfile = value
+		case "log":
+			a.logFile = value
+		case "socket":
+			a.socket = value
+		case "pidfile":
+			a.pidfile = value
+		case "entry_timeout":
+			a.fuse.EntryTimeout, err = intOption(o, value)
+		case "attr_timeout":
+			a.fuse.AttrTimeout, err = intOption(o, value)
+		case "negative_timeout":
+			a.fuse.NegativeTimeout, err = intOption(o, value)
+		case "max_readahead":
+			var v *int
+			if v, err = intOption(o, value); err == nil {
+				a.fuse.MaxReadAhead = *v
+			}
+		case "max_write":
+			var v *int
+			if v, err = intOption(o, value); err == nil {
+				a.fuse.MaxWrite = *v
+			}
+		case "debug":
+			a.fuse.Debug = true
+		case "defaults", "auto", "noauto", "users", "nouser", "owner", "group", "nofail", "_netdev", "comment":
+			// only meaningful to mount(8)
+		default:
+			if strings.HasPrefix(key, "x-") {
+				continue
+			}
+			a.fuse.MountOptions = append(a.fuse.MountOptions, o)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if a.user == "" {
+		return errors.New("missing option user=NAME")
+	}
+	if keyfile != "" {
+		f, err := openKeyfile(keyfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		a.password = &passwordSource{fd: int(f.Fd())}
+	}
+	return runMount(a)
+}
+
+// intOption returns the value of an option like max_write=N.
+func intOption(o, value string) (*int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid option %s, expected a number", o)
+	}
+	return &v, nil
+}
+
+// openKeyfile opens the file holding the password of the user on its first line.
+// Like the keys of ssh, it is refused if other users can read it.
+func openKeyfile(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		f.Close()
+		return nil, fmt.Errorf("keyfile %s is accessible by other users, its mode should be 0600", path)
+	}
+	return f, nil
+}
@@ -0,0 +1,290 @@
+package cli
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// groupPrefix marks the name of a group where a user is expected, as in share <path> group:NAME.
+const groupPrefix = "group:"
+
+// grantee is a user, or a group, a directory or a file is shared with.
+type grantee struct {
+	name   string
+	userId uint32
+	group  uint32
+	pubKey []byte
+}
+
+// findGrantee returns the user named name, or the group for a name starting with groupPrefix.
+func (u *User) findGrantee(name string) (*grantee, bool) {
+	g := &grantee{name: name}
+	if groupName, ok := strings.CutPrefix(name, groupPrefix); ok {
+		var owner uint32
+		if err := u.m.GetGroup(groupName, &g.group, &owner, &g.pubKey); err != nil {
+			fmt.Printf("No such group found: %s\n", groupName)
+			return nil, false
+		}
+		return g, true
+	}
+	if err := u.m.GetUserId(name, &g.userId); err != nil {
+		fmt.Printf("No such user found: %s\n", name)
+		return nil, false
+	}
+	if err := u.m.GetUserPublicKey(name, &g.pubKey); err != nil {
+		return nil, false
+	}
+	return g, true
+}
+
+func (g *grantee) share(m meta.Meta, inode meta.Ino, name, key []byte, readOnly bool) error {
+	if g.group != 0 {
+		return m.ShareGroup(g.group, inode, name, key, readOnly)
+	}
+	return m.Share(g.userId, inode, name, key, readOnly)
+}
+
+func (g *grantee) unshare(m meta.Meta, inode meta.Ino) error {
+	if g.group != 0 {
+		return m.UnshareGroup(g.group, inode)
+	}
+	return m.Unshare(g.userId, inode)
+}
+
+// createGroup creates the group name with a new key pair, the user being its owner
+// and first member.
+func (u *User) createGroup(name string) bool {
+	if name == "" {
+		fmt.Println("Group name is empty.")
+		return false
+	}
+	var userId uint32
+	err := u.m.GetUserId(u.username, &userId)
+	if err != nil {
+		return false
+	}
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return false
+	}
+	// the private key is too long for RSA, the members get a secret encrypting it
+	secret := make([]byte, DefaultKeyLength)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return false
+	}
+	defer clear(secret)
+	privCipher, err := u.enc.Encrypt(secret, x509.MarshalPKCS1PrivateKey(privKey))
+	if err != nil {
+		return false
+	}
+	secretCipher, err := u.enc.EncryptRSA(&u.privateKey.PublicKey, secret)
+	if err != nil {
+		return false
+	}
+	pubKeyBytes := x509.MarshalPKCS1PublicKey(&privKey.PublicKey)
+	err = u.m.CreateGroup(name, userId, pubKeyBytes, privCipher, secretCipher)
+	if err == syscall.EEXIST {
+		fmt.Printf("Group %s already exists.\n", name)
+	}
+	return err == nil
+}
+
+// ownGroup returns the ids of the group name and of the user, if the user owns the group.
+func (u *User) ownGroup(name string) (groupId, userId uint32, ok bool) {
+	var owner uint32
+	var pubKey []byte
+	if err := u.m.GetGroup(name, &groupId, &owner, &pubKey); err != nil {
+		fmt.Printf("No such group found: %s\n", name)
+		return 0, 0, false
+	}
+	if err := u.m.GetUserId(u.username, &userId); err != nil {
+		return 0, 0, false
+	}
+	if owner != userId {
+		fmt.Printf("Only the owner of group %s can change its members.\n", name)
+		return 0, 0, false
+	}
+	return groupId, userId, true
+}
+
+// addMember gives the user username the secret of the group, and so access to what is
+// shared with the group.
+func (u *User) addMember(groupName, username string) bool {
+	groupId, userId, ok := u.ownGroup(groupName)
+	if !ok {
+		return false
+	}
+	var keyCipher, secretCipher []byte
+	err := u.m.GetGroupKey(groupId, userId, &keyCipher, &secretCipher)
+	if err != nil {
+		return false
+	}
+	secret, err := u.enc.DecryptRSA(u.privateKey, secretCipher)
+	if err != nil {
+		return false
+	}
+	defer clear(secret)
+
+	var memberId uint32
+	err = u.m.GetUserId(username, &memberId)
+	if err != nil {
+		fmt.Printf("No such user found: %s\n", username)
+		return false
+	}
+	var pubKeyBytes []byte
+	err = u.m.GetUserPublicKey(username, &pubKeyBytes)
+	if err != nil {
+		return false
+	}
+	pubKey, err := x509.ParsePKCS1PublicKey(pubKeyBytes)
+	if err != nil {
+		return false
+	}
+	secretCipher, err = u.enc.EncryptRSA(pubKey, secret)
+	if err != nil {
+		return false
+	}
+	err = u.m.AddMember(groupId, memberId, secretCipher)
+	if err == syscall.EEXIST {
+		fmt.Printf("%s is already a member of %s.\n", username, groupName)
+	}
+	return err == nil
+}
+
+// removeMember removes the access of the user username to what is shared with the group,
+// and gives the group a new key pair, as the user knows the private key.
+func (u *User) removeMember(groupName, username string) bool {
+	groupId, userId, ok := u.ownGroup(groupName)
+	if !ok {
+		return false
+	}
+	var memberId uint32
+	err := u.m.GetUserId(username, &memberId)
+	if err != nil {
+		fmt.Printf("No such user found: %s\n", username)
+		return false
+	}
+	if memberId == userId {
+		fmt.Println("The owner of a group cannot be removed from it.")
+		return false
+	}
+	err = u.m.RemoveMember(groupId, memberId, func(keys *meta.GroupKeys) error {
+		return u.rekeyGroup(userId, keys)
+	})
+	if err == syscall.ENOENT {
+		fmt.Printf("%s is not a member of %s.\n", username, groupName)
+	}
+	return err == nil
+}
+
+// rekeyGroup replaces the key pair and the secret of a group, encrypting again for the new
+// public key the keys of what is shared with the group.
+func (u *User) rekeyGroup(userId uint32, keys *meta.GroupKeys) error {
+	var oldSecret []byte
+	for _, mb := range keys.Members {
+		if mb.User == userId {
+			oldSecret = mb.Secret
+		}
+	}
+	if oldSecret == nil {
+		return syscall.EACCES
+	}
+	secret, err := u.enc.DecryptRSA(u.privateKey, oldSecret)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := u.enc.Decrypt(secret, keys.PrKey)
+	clear(secret)
+	if err != nil {
+		return err
+	}
+	oldKey, err := x509.ParsePKCS1PrivateKey(keyBytes)
+	if err != nil {
+		return err
+	}
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	secret = make([]byte, DefaultKeyLength)
+	if _, err = rand.Read(secret); err != nil {
+		return err
+	}
+	defer clear(secret)
+	if keys.PrKey, err = u.enc.Encrypt(secret, x509.MarshalPKCS1PrivateKey(privKey)); err != nil {
+		return err
+	}
+	keys.PubKey = x509.MarshalPKCS1PublicKey(&privKey.PublicKey)
+	for _, mb := range keys.Members {
+		pubKey, err := x509.ParsePKCS1PublicKey(mb.PubKey)
+		if err != nil {
+			return err
+		}
+		if mb.Secret, err = u.enc.EncryptRSA(pubKey, secret); err != nil {
+			return err
+		}
+	}
+	for _, sh := range keys.Shares {
+		key, err := u.enc.DecryptRSA(oldKey, sh.Key)
+		if err != nil {
+			return err
+		}
+		sh.Key, err = u.enc.EncryptRSA(&privKey.PublicKey, key)
+		clear(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listMembers writes the members of the group, one per line.
+func (u *User) listMembers(w io.Writer, groupName string) bool {
+	var groupId, owner uint32
+	var pubKey []byte
+	err := u.m.GetGroup(groupName, &groupId, &owner, &pubKey)
+	if err != nil {
+		fmt.Printf("No such group found: %s\n", groupName)
+		return false
+	}
+	var members []string
+	err = u.m.ListMembers(groupId, &members)
+	if err != nil {
+		return false
+	}
+	for _, name := range members {
+		fmt.Fprintln(w, name)
+	}
+	return true
+}
+
+// groupKey returns the private key of a group of the user.
+func (u *User) groupKey(groupId uint32) (*rsa.PrivateKey, error) {
+	var userId uint32
+	if err := u.m.GetUserId(u.username, &userId); err != nil {
+		return nil, err
+	}
+	var keyCipher, secretCipher []byte
+	if err := u.m.GetGroupKey(groupId, userId, &keyCipher, &secretCipher); err != nil {
+		return nil, err
+	}
+	secret, err := u.enc.DecryptRSA(u.privateKey, secretCipher)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(secret)
+	keyBytes, err := u.enc.Decrypt(secret, keyCipher)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PrivateKey(keyBytes)
+}
@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/bastienvty/netsecfs/internal/config"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
 	"github.com/bastienvty/netsecfs/internal/fs"
@@ -14,13 +15,14 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-func mount(user User, blob object.ObjectStorage, mp string) (*fuse.Server, error) {
+// mount mounts the volume as configured by conf. Its mount options are added to
+// the FUSE mount options, it is mounted read-write unless they contain "ro".
+func mount(user User, blob object.ObjectStorage, format *meta.Format, conf *config.FUSE) (*fuse.Server, *fs.Node, error) {
 	var fuseOpts *gofs.Options
-	sec := time.Second
 	fuseOpts = &gofs.Options{
-		NegativeTimeout: &sec,
-		AttrTimeout:     &sec,
-		EntryTimeout:    &sec,
+		NegativeTimeout: timeout(conf.NegativeTimeout),
+		AttrTimeout:     timeout(conf.AttrTimeout),
+		EntryTimeout:    timeout(conf.EntryTimeout),
 		RootStableAttr: &gofs.StableAttr{
 			Ino: uint64(meta.RootInode),
 		},
@@ -28,18 +30,34 @@ func mount(user User, blob object.ObjectStorage, mp string) (*fuse.Server, error
 		GID: uint32(os.Getgid()),
 	}
 	fuseOpts.MountOptions = fuse.MountOptions{
-		Options: []string{"rw", "default_permissions"},
-		Debug:   false,
-		Name:    "netsecfs",
+		Options:      []string{"default_permissions"},
+		AllowOther:   conf.AllowOther,
+		MaxReadAhead: conf.MaxReadAhead,
+		MaxWrite:     conf.MaxWrite,
+		Debug:        conf.Debug,
+		Name:         "netsecfs",
+		FsName:       conf.Name,
 	}
+	mode := "rw"
+	for _, o := range conf.MountOptions {
+		switch o {
+		case "ro", "rw":
+			mode = o
+		case "allow_other":
+			fuseOpts.MountOptions.AllowOther = true
+		default:
+			fuseOpts.MountOptions.Options = append(fuseOpts.MountOptions.Options, o)
+		}
+	}
+	fuseOpts.MountOptions.Options = append(fuseOpts.MountOptions.Options, mode)
 	// fuseOpts.MountOptions.Options = append(fuseOpts.MountOptions.Options, "noapplexattr", "noappledouble") // macOS (optional)
 
 	syscall.Umask(0000)
-	root := fs.NewRootNode(user.m, blob, user.privateKey, user.rootKey, user.username)
-	server, err := gofs.Mount(mp, root, fuseOpts)
+	root := fs.NewRootNode(user.m, blob, format.BlockSize, user.privateKey, user.rootKey, user.username, mode == "ro")
+	server, err := gofs.Mount(conf.RootPath, root, fuseOpts)
 	if err != nil {
 		fmt.Println("Mount fail: ", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	fmt.Println("Unmount to stop the server.")
@@ -50,5 +68,14 @@ func mount(user User, blob object.ObjectStorage, mp string) (*fuse.Server, error
 		<-c
 		server.Unmount()
 	}()
-	return server, nil
+	return server, root, nil
+}
+
+// timeout returns a timeout of the configuration, one second if it is not set.
+func timeout(seconds *int) *time.Duration {
+	d := time.Second
+	if seconds != nil {
+		d = time.Duration(*seconds) * time.Second
+	}
+	return &d
 }
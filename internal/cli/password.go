@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const (
+	envPassword    = "NETSECFS_PASSWORD"
+	envNewPassword = "NETSECFS_NEW_PASSWORD"
+)
+
+// passwordSource reads the passwords of a command from a file descriptor, one per line,
+// from an env-file, or prompts for them on the terminal. They are never taken from argv.
+type passwordSource struct {
+	fd      int
+	envFile string
+
+	lines *bufio.Reader
+	env   map[string]string
+}
+
+func newPasswordSource(cmd *cobra.Command) *passwordSource {
+	fd, _ := cmd.Flags().GetInt("password-fd")
+	envFile, _ := cmd.Flags().GetString("env-file")
+	return &passwordSource{fd: fd, envFile: envFile}
+}
+
+// read returns the next password, found in the env-file under variable, or asked
+// with prompt and confirmed if needed.
+func (p *passwordSource) read(prompt, variable string, confirm bool) ([]byte, error) {
+	switch {
+	case p.fd >= 0:
+		if p.lines == nil {
+			p.lines = bufio.NewReader(os.NewFile(uintptr(p.fd), "password"))
+		}
+		line, err := p.lines.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, fmt.Errorf("read password from fd %d: %s", p.fd, err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	case p.envFile != "":
+		if p.env == nil {
+			env, err := parseEnvFile(p.envFile)
+			if err != nil {
+				return nil, err
+			}
+			p.env = env
+		}
+		pwd, ok := p.env[variable]
+		if !ok {
+			return nil, fmt.Errorf("%s is not set in %s", variable, p.envFile)
+		}
+		return []byte(pwd), nil
+	default:
+		return promptPassword(prompt, confirm)
+	}
+}
+
+// promptPassword asks for a password on the terminal without echoing it.
+func promptPassword(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no terminal to ask for the password, use --password-fd or --env-file")
+	}
+	fmt.Print(prompt)
+	pwd, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if len(pwd) == 0 {
+		return nil, errors.New("empty password")
+	}
+	if confirm {
+		fmt.Print("Confirm password: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			clear(pwd)
+			return nil, err
+		}
+		match := bytes.Equal(pwd, again)
+		clear(again)
+		if !match {
+			clear(pwd)
+			return nil, errors.New("passwords do not match")
+		}
+	}
+	return pwd, nil
+}
+
+// parseEnvFile reads the KEY=VALUE lines of a file in the format of systemd's EnvironmentFile.
+func parseEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in %s: %s", path, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[strings.TrimSpace(key)] = value
+	}
+	return env, scanner.Err()
+}
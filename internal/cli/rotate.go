@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/internal/fs"
+)
+
+// rekeyJob is a file whose blocks have to be re-encrypted after a rotation of its key.
+type rekeyJob struct {
+	inode  meta.Ino
+	length uint64
+	key    []byte
+	oldKey []byte
+}
+
+// rotate stops sharing path with username, like unshare, and encrypts its tree with new
+// keys, so that the keys obtained by the user no longer give access to it. The keys are
+// rotated even if it is not shared with the user anymore, after an unshare without rotation.
+// The blocks of the files are re-encrypted afterwards, in the background unless wait is set.
+func (u *User) rotate(path, username string, blob object.ObjectStorage, blockSize int, wait bool) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Println("Error getting file info:", err)
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		return false
+	}
+	inode := meta.Ino(stat.Ino)
+
+	g, ok := u.findGrantee(username)
+	if !ok {
+		return false
+	}
+	err = g.unshare(u.m, inode)
+	if err == syscall.EACCES {
+		fmt.Printf("%s is not yours.\n", path)
+	}
+	if err != nil && err != syscall.ENOENT {
+		return false
+	}
+
+	// the files of a previous rotation are finished first, their keys cannot change before
+	reencryptFiles(u.m, blob, blockSize, u.pendingRekeys())
+	var jobs []rekeyJob
+	err = u.m.RotateKeys(inode, func(tree []*meta.KeyNode) error {
+		var err error
+		jobs, err = u.rotateTree(tree)
+		return err
+	})
+	switch err {
+	case nil:
+	case syscall.EBUSY:
+		fmt.Printf("The files of %s are still re-encrypted after a previous rotation.\n", path)
+		return false
+	case syscall.EACCES:
+		fmt.Printf("%s is not yours or has links in directories that are not yours.\n", path)
+		return false
+	case syscall.EAGAIN:
+		fmt.Printf("%s kept changing during the rotation of its keys, try again.\n", path)
+		return false
+	default:
+		fmt.Println("Rotation of the keys failed:", err)
+		return false
+	}
+	if wait {
+		reencryptFiles(u.m, blob, blockSize, jobs)
+	} else {
+		go reencryptFiles(u.m, blob, blockSize, jobs)
+	}
+	return true
+}
+
+// rotateTree encrypts a tree with new keys, the nodes coming after a directory they are in.
+// It returns the files to re-encrypt.
+func (u *User) rotateTree(tree []*meta.KeyNode) ([]rekeyJob, error) {
+	inTree := make(map[meta.Ino]bool)
+	for _, kn := range tree {
+		inTree[kn.Inode] = true
+	}
+	outside := make(map[meta.Ino][]byte)
+	// parentKey returns the key of the parent of an entry, from keys if it is in the tree
+	parentKey := func(e *meta.KeyEdge, keys map[meta.Ino][]byte) ([]byte, error) {
+		if inTree[e.Parent] {
+			if key, ok := keys[e.Parent]; ok {
+				return key, nil
+			}
+			return nil, syscall.EACCES
+		}
+		if key, ok := outside[e.Parent]; ok {
+			return key, nil
+		}
+		key, err := u.pathKey(e.ParentKeys)
+		if err != nil {
+			return nil, syscall.EACCES
+		}
+		outside[e.Parent] = key
+		return key, nil
+	}
+
+	oldKeys := make(map[meta.Ino][]byte)
+	newKeys := make(map[meta.Ino][]byte)
+	for _, kn := range tree {
+		if kn.Pending {
+			return nil, syscall.EBUSY
+		}
+		for _, e := range kn.Edges {
+			if pk, err := parentKey(e, oldKeys); err == nil {
+				if key, err := u.enc.Decrypt(pk, e.Key); err == nil {
+					oldKeys[kn.Inode] = key
+					break
+				}
+			}
+		}
+		if oldKeys[kn.Inode] == nil {
+			return nil, syscall.EACCES
+		}
+		key := make([]byte, DefaultKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		newKeys[kn.Inode] = key
+	}
+
+	var jobs []rekeyJob
+	for _, kn := range tree {
+		old, key := oldKeys[kn.Inode], newKeys[kn.Inode]
+		for _, e := range kn.Edges {
+			pk, err := parentKey(e, newKeys)
+			if err != nil {
+				return nil, err
+			}
+			name, err := u.enc.Decrypt(old, e.Name)
+			if err != nil {
+				return nil, err
+			}
+			if e.Name, err = u.enc.Encrypt(key, name); err != nil {
+				return nil, err
+			}
+			if e.Key, err = u.enc.Encrypt(pk, key); err != nil {
+				return nil, err
+			}
+			if inTree[e.Parent] {
+				e.Hash = u.enc.Hash(pk, name)
+			}
+		}
+		for _, x := range kn.Xattrs {
+			name, err := u.enc.Decrypt(old, x.Name)
+			if err != nil {
+				return nil, err
+			}
+			value, err := u.enc.Decrypt(old, x.Value)
+			if err != nil {
+				return nil, err
+			}
+			x.Hash = u.enc.Hash(key, name)
+			if x.Name, err = u.enc.Encrypt(key, name); err != nil {
+				return nil, err
+			}
+			if x.Value, err = u.enc.Encrypt(key, value); err != nil {
+				return nil, err
+			}
+		}
+		if kn.Target != nil {
+			target, err := u.enc.Decrypt(old, kn.Target)
+			if err != nil {
+				return nil, err
+			}
+			if kn.Target, err = u.enc.Encrypt(key, target); err != nil {
+				return nil, err
+			}
+		}
+		// the users it is still shared with get the new key
+		for _, sh := range kn.Shares {
+			name, err := u.enc.Decrypt(old, sh.Name)
+			if err != nil {
+				return nil, err
+			}
+			if sh.Name, err = u.enc.Encrypt(key, name); err != nil {
+				return nil, err
+			}
+			pubKey, err := x509.ParsePKCS1PublicKey(sh.PubKey)
+			if err != nil {
+				return nil, err
+			}
+			if sh.Key, err = u.enc.EncryptRSA(pubKey, key); err != nil {
+				return nil, err
+			}
+		}
+		for _, a := range kn.Aliases {
+			name, err := u.enc.Decrypt(old, a.Name)
+			if err != nil {
+				return nil, err
+			}
+			if a.Name, err = u.enc.Encrypt(key, name); err != nil {
+				return nil, err
+			}
+		}
+		if kn.Type == meta.TypeFile && kn.Length > 0 {
+			var err error
+			if kn.Rekey, err = u.enc.Encrypt(key, old); err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, rekeyJob{inode: kn.Inode, length: kn.Length, key: key, oldKey: old})
+		}
+	}
+	return jobs, nil
+}
+
+// pathKey returns the clear key of a node from the keys of its path, as returned by GetPathKey.
+func (u *User) pathKey(keys [][]byte) ([]byte, error) {
+	// start at the root of the path
+	key := u.rootKey
+	for i := len(keys) - 1; i >= 0; i-- {
+		var err error
+		key, err = u.enc.Decrypt(key, keys[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// pendingRekeys returns the files of the user whose re-encryption after a rotation was
+// interrupted.
+func (u *User) pendingRekeys() []rekeyJob {
+	var inodes []meta.Ino
+	if u.m.ListRekeys(&inodes) != nil {
+		return nil
+	}
+	var jobs []rekeyJob
+	for _, inode := range inodes {
+		var keys [][]byte
+		if u.m.GetPathKey(inode, &keys) != nil {
+			continue
+		}
+		key, err := u.pathKey(keys)
+		if err != nil {
+			continue // a file of another user
+		}
+		var rekey []byte
+		if u.m.GetRekey(inode, &rekey) != nil {
+			continue
+		}
+		oldKey, err := u.enc.Decrypt(key, rekey)
+		if err != nil {
+			continue
+		}
+		var attr meta.Attr
+		if u.m.GetAttr(context.Background(), inode, &attr) != 0 {
+			continue
+		}
+		jobs = append(jobs, rekeyJob{inode: inode, length: attr.Length, key: key, oldKey: oldKey})
+	}
+	return jobs
+}
+
+// reencryptFiles re-encrypts the blocks of the files after a rotation, then forgets their
+// previous keys. The files that fail are tried again by the next rotation or mount.
+func reencryptFiles(m meta.Meta, blob object.ObjectStorage, blockSize int, jobs []rekeyJob) {
+	for _, j := range jobs {
+		err := fs.ReencryptBlocks(blob, j.inode, j.length, blockSize, j.key, j.oldKey)
+		if err == nil {
+			err = m.DoneRekey(j.inode)
+		}
+		if err != nil {
+			fmt.Printf("Re-encryption of inode %d failed: %s\n", j.inode, err)
+		}
+		clear(j.oldKey)
+	}
+}
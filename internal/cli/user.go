@@ -6,11 +6,14 @@ import (
 	"crypto/sha512"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"os"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/fs"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -42,7 +45,7 @@ func defaultParams() *params {
 
 type User struct {
 	username string
-	password string
+	password []byte
 
 	m          meta.Meta
 	enc        crypto.Crypto
@@ -52,7 +55,7 @@ type User struct {
 }
 
 func (u *User) createUser() bool {
-	if u.username == "" || u.password == "" {
+	if u.username == "" || len(u.password) == 0 {
 		fmt.Println("Username or password is empty.")
 		return false
 	}
@@ -66,7 +69,7 @@ func (u *User) createUser() bool {
 	if err != nil {
 		return false
 	}
-	masterKey := argon2.IDKey([]byte(u.password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	masterKey := argon2.IDKey(u.password, salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 
 	hashMaster := sha512.New()
 	_, err = hashMaster.Write(masterKey)
@@ -109,7 +112,7 @@ func (u *User) createUser() bool {
 }
 
 func (u *User) verifyUser() bool {
-	if u.username == "" || u.password == "" {
+	if u.username == "" || len(u.password) == 0 {
 		fmt.Println("Username or password is empty.")
 		return false
 	}
@@ -119,7 +122,7 @@ func (u *User) verifyUser() bool {
 	if err != nil {
 		return false
 	}
-	masterKey := argon2.IDKey([]byte(u.password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	masterKey := argon2.IDKey(u.password, salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 
 	hashMaster := sha512.New()
 	_, err = hashMaster.Write(masterKey)
@@ -153,8 +156,8 @@ func (u *User) verifyUser() bool {
 	return true
 }
 
-func (u *User) changePassword(newPassword string) bool {
-	if u.username == "" || u.password == "" || newPassword == "" {
+func (u *User) changePassword(newPassword []byte) bool {
+	if u.username == "" || len(u.password) == 0 || len(newPassword) == 0 {
 		fmt.Println("Username or password is empty.")
 		return false
 	}
@@ -164,7 +167,7 @@ func (u *User) changePassword(newPassword string) bool {
 	if err != nil {
 		return false
 	}
-	newMasterKey := argon2.IDKey([]byte(newPassword), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	newMasterKey := argon2.IDKey(newPassword, salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 	hashMaster := sha512.New()
 	_, err = hashMaster.Write(newMasterKey)
 	if err != nil {
@@ -188,13 +191,29 @@ func (u *User) changePassword(newPassword string) bool {
 		return false
 	}
 
+	clear(u.password)
+	clear(u.masterKey)
 	u.password = newPassword
 	u.masterKey = newMasterKey
 	return true
 }
 
-func (u *User) shareDir(dir, username string) bool {
-	info, err := os.Stat(dir)
+// wipe overwrites the password and the keys of the user, so that they do not
+// stay in memory after a logout.
+func (u *User) wipe() {
+	clear(u.password)
+	clear(u.masterKey)
+	clear(u.rootKey)
+	u.password = nil
+	u.masterKey = nil
+	u.rootKey = nil
+	u.privateKey = nil
+}
+
+// share gives the user username, or the members of the group for group:NAME, access to a directory or a regular file, with
+// its key wrapped by the public key of the user, read-only or not.
+func (u *User) share(path, username string, readOnly bool) bool {
+	info, err := os.Stat(path)
 	if err != nil {
 		fmt.Println("Error getting file info:", err)
 		return false
@@ -209,16 +228,14 @@ func (u *User) shareDir(dir, username string) bool {
 		return false
 	}
 
-	if !info.IsDir() {
-		fmt.Printf("%s is not a directory.\n", dir)
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		fmt.Printf("%s is not a directory or a regular file.\n", path)
 		return false
 	}
 	inode := stat.Ino
 
-	var userId uint32
-	err = u.m.GetUserId(username, &userId)
-	if err != nil {
-		fmt.Printf("No such user found: %s\n", username)
+	g, ok := u.findGrantee(username)
+	if !ok {
 		return false
 	}
 
@@ -228,28 +245,18 @@ func (u *User) shareDir(dir, username string) bool {
 		return false
 	}
 
-	// start at the root of the path
-	key := u.rootKey
-	for i := len(keys) - 1; i >= 0; i-- {
-		key, err = u.enc.Decrypt(key, keys[i])
-		if err != nil {
-			return false
-		}
-	}
-
-	name := []byte(info.Name())
-	nameCipher, err := u.enc.Encrypt(key, name)
+	key, err := u.pathKey(keys)
 	if err != nil {
 		return false
 	}
 
-	var pubKeyBytes []byte
-	err = u.m.GetUserPublicKey(username, &pubKeyBytes)
+	name := []byte(info.Name())
+	nameCipher, err := u.enc.Encrypt(key, name)
 	if err != nil {
 		return false
 	}
 
-	pubKey, err := x509.ParsePKCS1PublicKey(pubKeyBytes)
+	pubKey, err := x509.ParsePKCS1PublicKey(g.pubKey)
 	if err != nil {
 		return false
 	}
@@ -258,12 +265,19 @@ func (u *User) shareDir(dir, username string) bool {
 		return false
 	}
 
-	err = u.m.ShareDir(userId, meta.Ino(inode), nameCipher, key)
+	err = g.share(u.m, meta.Ino(inode), nameCipher, key, readOnly)
+	switch err {
+	case syscall.EEXIST:
+		fmt.Printf("%s is already shared with %s.\n", path, username)
+	case syscall.EACCES:
+		fmt.Printf("%s is not yours.\n", path)
+	}
 	return err == nil
 }
 
-func (u *User) unshareDir(dir, username string) bool {
-	info, err := os.Stat(dir)
+// unshare removes the access of the user username, or of the group for group:NAME, to a directory or a file.
+func (u *User) unshare(path, username string) bool {
+	info, err := os.Stat(path)
 	if err != nil {
 		fmt.Println("Error getting file info:", err)
 		return false
@@ -278,19 +292,111 @@ func (u *User) unshareDir(dir, username string) bool {
 		return false
 	}
 
-	if !info.IsDir() {
-		fmt.Printf("%s is not a directory.\n", dir)
+	inode := stat.Ino
+
+	g, ok := u.findGrantee(username)
+	if !ok {
 		return false
 	}
-	inode := stat.Ino
 
+	err = g.unshare(u.m, meta.Ino(inode))
+	switch err {
+	case syscall.ENOENT:
+		fmt.Printf("%s is not shared with %s.\n", path, username)
+	case syscall.EACCES:
+		fmt.Printf("%s is not yours.\n", path)
+	}
+	return err == nil
+}
+
+// listShares writes the directories and files the user shares, with their path in the
+// volume, or with incoming the ones shared with the user, with their path in its shared
+// directory.
+func (u *User) listShares(w io.Writer, incoming bool) bool {
 	var userId uint32
-	err = u.m.GetUserId(username, &userId)
+	err := u.m.GetUserId(u.username, &userId)
 	if err != nil {
-		fmt.Printf("No such user found: %s\n", username)
+		return false
+	}
+	var shares []*meta.ShareInfo
+	err = u.m.ListShares(userId, incoming, &shares)
+	if err != nil {
+		fmt.Println("Error listing the shares:", err)
 		return false
 	}
 
-	err = u.m.UnshareDir(userId, meta.Ino(inode))
-	return err == nil
+	// the names in the shared directory depend on all the shares with the user
+	var names map[meta.Ino]string
+	if incoming {
+		if names, err = fs.SharedNames(u.m, userId, u.sharedKey); err != nil {
+			fmt.Println("Error listing the shares:", err)
+			return false
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if incoming {
+		fmt.Fprintln(tw, "PATH\tOWNER\tACCESS\tVIA")
+	} else {
+		fmt.Fprintln(tw, "PATH\tUSER\tACCESS")
+	}
+	for _, sh := range shares {
+		access := "rw"
+		if sh.ReadOnly {
+			access = "ro"
+		}
+		if incoming {
+			// shared with the user directly, or with one of its groups
+			via := "-"
+			if sh.Group != 0 {
+				via = sh.User
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", incomingPath(names, sh), sh.Owner, access, via)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.sharePath(sh), sh.User, access)
+		}
+	}
+	return tw.Flush() == nil
+}
+
+// sharePath returns the path in the volume of a node shared by the user.
+func (u *User) sharePath(sh *meta.ShareInfo) string {
+	var path string
+	// start at the root of the path
+	key := u.rootKey
+	for i := len(sh.PathKeys) - 1; i >= 0; i-- {
+		var name []byte
+		var err error
+		key, err = u.enc.Decrypt(key, sh.PathKeys[i])
+		if err == nil {
+			name, err = u.enc.Decrypt(key, sh.PathNames[i])
+		}
+		if err != nil {
+			return fmt.Sprintf("inode %d", sh.Inode)
+		}
+		path += "/" + string(name)
+	}
+	return path
+}
+
+// incomingPath returns the path of a node shared with the user, in its shared directory
+// whose names are given by inode.
+func incomingPath(names map[meta.Ino]string, sh *meta.ShareInfo) string {
+	name, ok := names[sh.Inode]
+	if !ok {
+		return fmt.Sprintf("inode %d", sh.Inode)
+	}
+	return "/shared/" + name
+}
+
+// sharedKey returns the clear key of a node shared with the user, directly or through a group.
+func (u *User) sharedKey(e *meta.Entry) ([]byte, error) {
+	privKey := u.privateKey
+	if e.Group != 0 {
+		var err error
+		if privKey, err = u.groupKey(e.Group); err != nil {
+			return nil, err
+		}
+	}
+	return u.enc.DecryptRSA(privKey, e.Key)
 }
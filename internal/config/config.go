@@ -1,10 +1,70 @@
 package config
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FUSE is the configuration of a mount, read from a YAML or JSON file and
+// completed by the flags of the mount command. Timeouts are in seconds.
 type FUSE struct {
-	RootPath     string   `json:"root_path"`
-	MountOptions []string `json:"mount_options,omitempty"`
-	Name         string   `json:"display_name,omitempty"`
+	RootPath     string   `json:"root_path" yaml:"root_path"`
+	MountOptions []string `json:"mount_options,omitempty" yaml:"mount_options,omitempty"`
+	Name         string   `json:"display_name,omitempty" yaml:"display_name,omitempty"`
+
+	EntryTimeout    *int `json:"entry_timeout,omitempty" yaml:"entry_timeout,omitempty"`
+	AttrTimeout     *int `json:"attr_timeout,omitempty" yaml:"attr_timeout,omitempty"`
+	NegativeTimeout *int `json:"negative_timeout,omitempty" yaml:"negative_timeout,omitempty"`
+
+	AllowOther   bool `json:"allow_other,omitempty" yaml:"allow_other,omitempty"`
+	MaxReadAhead int  `json:"max_readahead,omitempty" yaml:"max_readahead,omitempty"`
+	MaxWrite     int  `json:"max_write,omitempty" yaml:"max_write,omitempty"`
+	Debug        bool `json:"debug,omitempty" yaml:"debug,omitempty"`
+}
+
+// Load reads the configuration from a JSON file if its name ends with .json,
+// from a YAML file otherwise.
+func Load(path string) (*FUSE, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := new(FUSE)
+	if filepath.Ext(path) == ".json" {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		err = d.Decode(conf)
+	} else {
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		if err = d.Decode(conf); err != nil && len(bytes.TrimSpace(data)) == 0 {
+			err = nil // an empty file keeps the defaults
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", path, err)
+	}
+	return conf, nil
+}
 
-	EntryTimeout *int `json:"entry_timeout,omitempty"`
-	AttrTimeout  *int `json:"attr_timeout,omitempty"`
+// Check returns an error if a value of the configuration is out of range.
+func (c *FUSE) Check() error {
+	for name, t := range map[string]*int{
+		"entry_timeout":    c.EntryTimeout,
+		"attr_timeout":     c.AttrTimeout,
+		"negative_timeout": c.NegativeTimeout,
+	} {
+		if t != nil && *t < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+	if c.MaxReadAhead < 0 || c.MaxWrite < 0 {
+		return fmt.Errorf("max_readahead and max_write cannot be negative")
+	}
+	return nil
 }
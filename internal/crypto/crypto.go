@@ -3,10 +3,14 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
 	"io"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 type Crypto interface {
@@ -14,6 +18,7 @@ type Crypto interface {
 	Decrypt(key, ciphertext []byte) ([]byte, error)
 	EncryptRSA(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error)
 	DecryptRSA(privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error)
+	Hash(key, data []byte) []byte
 }
 
 type CryptoHelper struct {
@@ -106,3 +111,18 @@ func (c *CryptoHelper) DecryptRSA(privKey *rsa.PrivateKey, ciphertext []byte) ([
 	}
 	return decrypted, nil
 }
+
+// hashInfo binds the keys derived for Hash to their use.
+const hashInfo = "netsecfs name hash"
+
+// Hash returns a keyed digest of data, used to find an encrypted name without decrypting it.
+// Its key is derived from key, which also encrypts the name, so that neither use weakens the other.
+func (c *CryptoHelper) Hash(key, data []byte) []byte {
+	hashKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(hashInfo)), hashKey); err != nil {
+		panic(err.Error()) // only when reading more than 255 digests
+	}
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -6,12 +6,13 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/bastienvty/netsecfs/utils"
 )
 
 const (
 	TypeFile      = 1 // type for regular file
 	TypeDirectory = 2 // type for directory
+	TypeSymlink   = 3 // type for symlink
 )
 
 const (
@@ -27,7 +28,21 @@ const (
 	SetAttrMtimeNow
 )
 
+const (
+	RenameNoReplace = 1 << iota
+	RenameExchange
+	RenameWhiteout
+)
+
+const (
+	XattrCreate  = 1
+	XattrReplace = 2
+)
+
 const MaxName = 255
+const MaxSymlink = 4096
+const MaxXattrName = 255
+const MaxXattrValue = 65536
 
 type Ino uint64
 
@@ -51,6 +66,8 @@ func (i Ino) IsNormal() bool {
 type Attr struct {
 	Typ       uint8  // type of a node
 	Mode      uint16 // permission mode
+	Uid       uint32 // id of the user owning the node
+	Gid       uint32 // group id of the node
 	Rdev      uint32 // device number
 	Atime     int64  // last access time
 	Mtime     int64  // last modified time
@@ -71,6 +88,8 @@ func typeToStatType(_type uint8) uint32 {
 		return syscall.S_IFDIR
 	case TypeFile:
 		return syscall.S_IFREG
+	case TypeSymlink:
+		return syscall.S_IFLNK
 	default:
 		panic(_type)
 	}
@@ -82,6 +101,8 @@ func typeToString(_type uint8) string {
 		return "regular"
 	case TypeDirectory:
 		return "directory"
+	case TypeSymlink:
+		return "symlink"
 	default:
 		return "unknown"
 	}
@@ -93,6 +114,8 @@ func typeFromString(s string) uint8 {
 		return TypeFile
 	case "directory":
 		return TypeDirectory
+	case "symlink":
+		return TypeSymlink
 	default:
 		panic(s)
 	}
@@ -108,7 +131,114 @@ type Entry struct {
 	Inode Ino
 	Name  []byte
 	Key   []byte
-	Attr  *Attr
+	// Hash is the hash of the clear name, empty for the entries older than the hashes.
+	Hash []byte
+	Attr *Attr
+	// ReadOnly is set for the entries of the shared directory that cannot be changed.
+	ReadOnly bool
+	// Group is set for the entries of the shared directory shared with a group of the
+	// user, their key being encrypted for the group.
+	Group uint32
+	// Owner is the name of the user who shared an entry of the shared directory, and Alias
+	// the name the user gave it, encrypted by its key, if any.
+	Owner string
+	Alias []byte
+}
+
+// KeyNode is a node of a tree whose keys are rotated, with everything encrypted by
+// its key. The rotation replaces the encrypted fields in place.
+type KeyNode struct {
+	Inode  Ino
+	Type   uint8
+	Length uint64
+	// Edges are all the entries of the node, inside the tree or not.
+	Edges  []*KeyEdge
+	Xattrs []*KeyXattr
+	Target []byte // target of a symlink
+	Shares []*KeyShare
+	// Aliases are the names given to the node by the users it is shared with.
+	Aliases []*KeyAlias
+	// Rekey is set by the rotation for a file with data: its previous key, encrypted by
+	// the new one, kept until its blocks are re-encrypted.
+	Rekey []byte
+	// Pending is true if the blocks of the file are not re-encrypted yet after a previous rotation.
+	Pending bool
+}
+
+// KeyEdge is an entry of a node whose keys are rotated.
+type KeyEdge struct {
+	id     int64
+	Parent Ino
+	Name   []byte
+	Hash   []byte
+	Key    []byte
+	// ParentKeys are the keys of the path from the parent to the root, if the parent is not in the tree.
+	ParentKeys [][]byte
+}
+
+// KeyXattr is an extended attribute of a node whose keys are rotated.
+type KeyXattr struct {
+	id    int64
+	Hash  []byte
+	Name  []byte
+	Value []byte
+}
+
+// KeyShare is a share of a node whose keys are rotated, with the public key of the user
+// or group.
+type KeyShare struct {
+	id     int64
+	User   uint32
+	Group  uint32
+	PubKey []byte
+	Name   []byte
+	Key    []byte
+}
+
+// KeyAlias is the name a user gave to a node whose keys are rotated.
+type KeyAlias struct {
+	id   int64
+	Name []byte
+}
+
+// GroupKeys are the keys of a group whose key pair is replaced after a member was removed.
+// The private key is encrypted by the secret of the group, given to each member encrypted
+// by its public key, and the keys of the nodes shared with the group are encrypted by its
+// public key.
+type GroupKeys struct {
+	PubKey  []byte
+	PrKey   []byte
+	Members []*GroupMember
+	Shares  []*GroupShare
+}
+
+// GroupMember is a member of a group whose key pair is replaced.
+type GroupMember struct {
+	User   uint32
+	PubKey []byte
+	Secret []byte
+}
+
+// GroupShare is a node shared with a group whose key pair is replaced.
+type GroupShare struct {
+	id  int64
+	Key []byte
+}
+
+// ShareInfo is a share of a node with a user, as listed by ListShares.
+type ShareInfo struct {
+	Inode    Ino
+	Type     uint8
+	Owner    string // user owning the tree of the node
+	User     string // user the node is shared with, or group:NAME
+	Group    uint32 // group the node is shared with, if any
+	ReadOnly bool
+	Name     []byte // name of the node, encrypted by its key
+	Key      []byte // key of the node, encrypted for the user
+	// PathKeys and PathNames are the keys and names of the entries from the node up to
+	// the root, encrypted as in the directories, for the owner to decrypt the path.
+	PathKeys  [][]byte
+	PathNames [][]byte
 }
 
 // Meta is a interface for a meta service for file system.
@@ -120,41 +250,120 @@ type Meta interface {
 	// Shutdown close current database connections.
 	Shutdown()
 	Load() (*Format, error)
-	GetNextInode(ctx context.Context, lastIno *Ino) error
 	GetUserId(username string, uid *uint32) error
+	GetUsername(uid uint32, username *string) error
 	GetUserPublicKey(username string, pubKey *[]byte) error
+	// SetUser sets the user doing the changes, who cannot change what is shared read-only with it.
+	SetUser(userId uint32)
 
-	// Lookup returns the inode and attributes for the given entry in a directory.
-	Lookup(ctx context.Context, userId uint32, parent, inode Ino, attr *Attr) syscall.Errno
+	// Lookup returns the inode, wrapped key and attributes of the entry of a directory found by the hash of its name.
+	Lookup(ctx context.Context, userId uint32, parent Ino, hash []byte, inode *Ino, key *[]byte, attr *Attr) syscall.Errno
 	// GetAttr returns the attributes for given node.
 	GetAttr(ctx context.Context, inode Ino, attr *Attr) syscall.Errno
 	// SetAttr updates the attributes for given node.
-	SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, attr *Attr) syscall.Errno
+	SetAttr(ctx context.Context, inode Ino, set uint16, attr *Attr) syscall.Errno
 	// Unlink removes a file entry from a directory.
 	// The file will be deleted if it's not linked by any entries and not open by any sessions.
-	Unlink(ctx context.Context, parent, inode Ino) syscall.Errno
-	// Rmdir removes an empty sub-directory.
-	Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno
+	// attr is filled with the attributes of the node after the entry is removed.
+	// hash is the hash of the name of the entry, which tells apart the links of a node.
+	Unlink(ctx context.Context, parent, inode Ino, hash []byte, attr *Attr) syscall.Errno
+	// Rmdir removes an empty sub-directory, found by the hash of its name.
+	Rmdir(ctx context.Context, parent, inode Ino, hash []byte) syscall.Errno
+	// SetHash saves the hash of the name of an entry of a directory, found by its encrypted name,
+	// when it has none or one made differently.
+	SetHash(ctx context.Context, parent Ino, name, hash []byte) syscall.Errno
 	// Readdir returns all entries for given directory, which include attributes if plus is true.
 	Readdir(ctx context.Context, inode Ino, userId uint32, entries *[]*Entry) syscall.Errno
-	Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, key []byte, attr *Attr) syscall.Errno
-	// Write put a slice of data on top of the given chunk.
+	// Link creates an entry for the node in the given directory with the key wrapped for this directory.
+	Link(ctx context.Context, inode, parent Ino, name, hash, key []byte, attr *Attr) syscall.Errno
+	// Rename moves an entry, found by the hash srcHash of its name, from a source directory to another
+	// with the given encrypted name, hash and key.
+	// dstInode is the entry replaced at the destination, if any; dstName and dstKey are its new name
+	// and key when both entries are exchanged. attr is filled with the attributes of the replaced entry.
+	Rename(ctx context.Context, parentSrc, inode Ino, srcHash []byte, parentDst, dstInode Ino, flags uint32, name, hash, key, dstName, dstKey []byte, attr *Attr) syscall.Errno
+	// Mknod creates a node in a directory with the given encrypted name, hash of the clear name and key.
+	// inode is filled with a new inode allocated for the node, or the existing one on EEXIST.
+	Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, hash, key []byte, attr *Attr) syscall.Errno
+	// Symlink creates a symlink in a directory with the given encrypted target.
+	Symlink(ctx context.Context, parent Ino, id uint32, inode *Ino, name, hash, key, path []byte, attr *Attr) syscall.Errno
+	// ReadLink returns the encrypted target of a symlink.
+	ReadLink(ctx context.Context, inode Ino, path *[]byte) syscall.Errno
+	// Write updates the length and mtime of the given file after a slice of data was written at off.
 	Write(ctx context.Context, inode uint64, data []byte, off int64) syscall.Errno
-	GetKey(ctx context.Context, inode Ino, key *[]byte) syscall.Errno
-	GetSharedKey(ctx context.Context, userdId uint32, inode Ino, key *[]byte) syscall.Errno
+	// GetXattr returns the encrypted value of the extended attribute found by the hash of its name.
+	GetXattr(ctx context.Context, inode Ino, hash []byte, vbuff *[]byte) syscall.Errno
+	// ListXattr returns the encrypted names of all the extended attributes of a node.
+	ListXattr(ctx context.Context, inode Ino, names *[][]byte) syscall.Errno
+	// SetXattr updates or creates an extended attribute with an encrypted name and value.
+	// The root has no extended attributes, each user seeing it with a key of its own.
+	SetXattr(ctx context.Context, inode Ino, hash, name, value []byte, flags uint32) syscall.Errno
+	// RemoveXattr removes the extended attribute found by the hash of its name.
+	RemoveXattr(ctx context.Context, inode Ino, hash []byte) syscall.Errno
 
 	CheckUser(username string) error
 	CreateUser(username string, password, salt, rootKey, privKey, pubKey []byte) error
 	VerifyUser(username string, password []byte, rootKey, privKey *[]byte) error
 	GetSalt(username string, salt *[]byte) error
 	ChangePassword(username string, password, salt, rootKey, privKey []byte) error
-	ShareDir(user uint32, inode Ino, name, key []byte) error
-	UnshareDir(user uint32, inode Ino) error
+	// Share gives a user access to a directory or a regular file, under a name and with
+	// a key encrypted for this user, read-only or not. It fails with EEXIST if it is already
+	// shared with the user.
+	Share(user uint32, inode Ino, name, key []byte, readOnly bool) error
+	// Unshare removes the access of a user to a directory or file, ENOENT if it had none.
+	Unshare(user uint32, inode Ino) error
+	// ShareGroup gives the members of a group access to a directory or a regular file, with
+	// its key encrypted for the group. It fails with EEXIST if it is already shared with the group.
+	ShareGroup(group uint32, inode Ino, name, key []byte, readOnly bool) error
+	// UnshareGroup removes the access of a group to a directory or file, ENOENT if it had none.
+	UnshareGroup(group uint32, inode Ino) error
+	// ListShares returns the shares of the nodes in the tree of the user, or the shares
+	// with the user and its groups if incoming is set.
+	ListShares(user uint32, incoming bool, shares *[]*ShareInfo) error
+	// SetAlias sets the name under which a node shared with a user appears in its shared
+	// directory, encrypted by the key of the node, or removes it if name is nil. ENOENT if
+	// the node is not shared with the user.
+	SetAlias(user uint32, inode Ino, name []byte) error
+
+	// CreateGroup creates a group with its key pair, the private key being encrypted by the secret
+	// of the group, and the owner as first member, with the secret encrypted for it. EEXIST if
+	// the name is taken.
+	CreateGroup(name string, owner uint32, pubKey, privKey, secret []byte) error
+	// GetGroup returns the id, owner and public key of the group name, ENOENT if there is none.
+	GetGroup(name string, group, owner *uint32, pubKey *[]byte) error
+	// GetGroupKey returns the encrypted private key of a group and its secret encrypted for the
+	// user, ENOENT if the user is not a member.
+	GetGroupKey(group, user uint32, privKey, secret *[]byte) error
+	// AddMember adds a user to a group with the secret of the group encrypted for it, EEXIST if
+	// it is already a member.
+	AddMember(group, user uint32, secret []byte) error
+	// RemoveMember removes a user from a group, ENOENT if it was not a member, and lets
+	// rekey give the group a new key pair, so that the private key the user knew is useless.
+	RemoveMember(group, user uint32, rekey func(*GroupKeys) error) error
+	// ListMembers returns the names of the members of a group.
+	ListMembers(group uint32, members *[]string) error
 	GetPathKey(inode Ino, keys *[][]byte) error
+	// RotateKeys loads the tree of the node and lets rotate encrypt it with new keys, out of
+	// any transaction, then saves it, along with the previous keys of the files, in a single
+	// transaction if it did not change meanwhile. Otherwise rotate is called again on the
+	// new tree, and EAGAIN returned if it keeps changing.
+	RotateKeys(inode Ino, rotate func(tree []*KeyNode) error) error
+	// GetRekey returns the previous key of a file, encrypted by its current key, while its
+	// blocks are re-encrypted after a rotation, ENOENT if there is none.
+	GetRekey(inode Ino, key *[]byte) error
+	// ListRekeys returns the files whose blocks are not re-encrypted yet after a rotation.
+	ListRekeys(inodes *[]Ino) error
+	// DoneRekey forgets the previous key of a file once its blocks are re-encrypted.
+	DoneRekey(inode Ino) error
 }
 
-func RegisterMeta(addr string) Meta {
-	m, err := newSQLMeta("sqlite3", addr)
+// RegisterMeta connects to the meta database at addr. When readOnly, any change
+// of the volume fails with EROFS.
+func RegisterMeta(addr string, readOnly bool) Meta {
+	driver, dsn := utils.ParseDataSource(addr)
+	if readOnly {
+		dsn = utils.ReadOnlyDataSource(driver, dsn)
+	}
+	m, err := newSQLMeta(driver, dsn, readOnly)
 	if err != nil {
 		logger.Fatalf("unable to register client: %s", err)
 	}
@@ -6,16 +6,17 @@ import (
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
-	"log"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bastienvty/netsecfs/utils"
-	"github.com/hanwen/go-fuse/v2/fuse"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"xorm.io/xorm"
@@ -29,13 +30,19 @@ type setting struct {
 	Value string `xorm:"varchar(4096) notnull"`
 }
 
+type counter struct {
+	Name  string `xorm:"pk"`
+	Value int64  `xorm:"notnull"`
+}
+
 type edge struct {
 	Id     int64  `xorm:"pk bigserial"`
-	Parent Ino    `xorm:"unique(edge) notnull"`
-	Name   []byte `xorm:"unique(edge) varbinary(255) notnull"`
+	Parent Ino    `xorm:"unique(entry) notnull"`
+	Name   []byte `xorm:"varbinary(255) notnull"`
 	Inode  Ino    `xorm:"index notnull"`
 	Type   uint8  `xorm:"notnull"`
 	Key    []byte
+	Hash   []byte `xorm:"unique(entry) varbinary(32)"` // keyed digest of the clear name, to find an entry without decrypting the others
 }
 
 type node struct {
@@ -53,12 +60,32 @@ type node struct {
 	Rdev      uint32
 	Parent    Ino
 	Owner     uint32
+	Gid       uint32
+}
+
+type symlink struct {
+	Inode  Ino    `xorm:"pk"`
+	Target []byte `xorm:"blob notnull"`
+}
+
+type xattr struct {
+	Id    int64  `xorm:"pk bigserial"`
+	Inode Ino    `xorm:"unique(name) notnull"`
+	Hash  []byte `xorm:"unique(name) varbinary(32) notnull"`
+	Name  []byte `xorm:"blob notnull"`
+	Value []byte `xorm:"blob notnull"`
 }
 
 type namedNode struct {
-	node `xorm:"extends"`
-	Name []byte `xorm:"varbinary(255)"`
-	Key  []byte
+	Node     node   `xorm:"extends"`
+	Name     []byte `xorm:"varbinary(255)"`
+	Key      []byte
+	Hash     []byte `xorm:"varbinary(32)"`
+	ReadOnly bool
+	GroupId  uint32
+	Sharer   uint32
+	Alias    []byte
+	Owner    string `xorm:"-"` // username of the sharer
 }
 
 type user struct {
@@ -71,21 +98,82 @@ type user struct {
 	PubKey   []byte `xorm:"notnull"`
 }
 
+// shared gives a user, or the members of a group when GroupId is set, access to a node.
 type shared struct {
+	Id      int64  `xorm:"pk autoincr"`
+	Inode   Ino    `xorm:"unique(share) notnull"`
+	Name    []byte `xorm:"varbinary(255) notnull"`
+	User    uint32 `xorm:"unique(share) notnull"`
+	GroupId uint32 `xorm:"unique(share) notnull default 0"`
+	// Sharer is the owner of the tree of the node, 0 for the shares older than this column
+	Sharer   uint32 `xorm:"notnull default 0"`
+	Key      []byte `xorm:"notnull"`
+	ReadOnly bool   `xorm:"notnull default false"`
+}
+
+// alias is the name a user gives to a node shared with it, encrypted by the key of the node.
+type alias struct {
 	Id    int64  `xorm:"pk autoincr"`
-	Inode Ino    `xorm:"notnull"`
-	Name  []byte `xorm:"unique(edge) varbinary(255) notnull"`
-	User  uint32 `xorm:"notnull"`
+	Inode Ino    `xorm:"unique(alias) notnull"`
+	User  uint32 `xorm:"unique(alias) notnull"`
+	Name  []byte `xorm:"varbinary(255) notnull"`
+}
+
+// sharedWith is the condition on nsfs_shared of the shares with a user, given twice,
+// directly or through its groups.
+const sharedWith = "(nsfs_shared.user = ? OR nsfs_shared.group_id IN " +
+	"(SELECT nsfs_member.group_id FROM nsfs_member WHERE nsfs_member.user = ?))"
+
+// group has its own key pair, its private key being encrypted by a secret that
+// each member gets encrypted by its public key.
+type group struct {
+	Id     uint32 `xorm:"pk autoincr"`
+	Name   string `xorm:"notnull unique"`
+	Owner  uint32 `xorm:"notnull"`
+	PubKey []byte `xorm:"notnull"`
+	PrKey  []byte `xorm:"notnull"`
+}
+
+type member struct {
+	Id      int64  `xorm:"pk autoincr"`
+	GroupId uint32 `xorm:"unique(member) notnull"`
+	User    uint32 `xorm:"unique(member) notnull"`
+	Secret  []byte `xorm:"notnull"`
+}
+
+// memberKey is a member of a group with the public key of the user.
+type memberKey struct {
+	Member member `xorm:"extends"`
+	PubKey []byte
+}
+
+// rekey is the previous key of a file, encrypted by its current key, while its
+// blocks are re-encrypted after a rotation of the keys.
+type rekey struct {
+	Inode Ino    `xorm:"pk"`
 	Key   []byte `xorm:"notnull"`
 }
 
+// inodeBatch is the number of inodes reserved at once by a client.
+const inodeBatch = 100
+
+// freeID is a range of ids reserved by this client, next is the last one used.
+type freeID struct {
+	next  uint64
+	maxid uint64
+}
+
 type dbMeta struct {
 	sync.Mutex
 	db   *xorm.Engine
 	addr string
 	fmt  *Format
 
-	root Ino
+	root       Ino
+	readOnly   bool
+	userId     uint32 // user doing the changes, 0 if unknown
+	freeMu     sync.Mutex
+	freeInodes freeID
 }
 
 func errno(err error) syscall.Errno {
@@ -115,6 +203,11 @@ func (m *dbMeta) Load() (*Format, error) {
 	if err = json.Unmarshal(body, format); err != nil {
 		return nil, fmt.Errorf("json: %s", err)
 	}
+	if !m.readOnly {
+		if err = m.initCounters(); err != nil {
+			return nil, err
+		}
+	}
 	m.Lock()
 	m.fmt = format
 	m.Unlock()
@@ -139,14 +232,14 @@ func (m *dbMeta) doLoad() (data []byte, err error) {
 }
 
 func (m *dbMeta) Init(format *Format) error {
-	if err := m.db.Sync2(new(setting)); err != nil {
-		return fmt.Errorf("create table setting: %s", err)
+	if err := m.db.Sync2(new(setting), new(counter)); err != nil {
+		return fmt.Errorf("create table setting, counter: %s", err)
 	}
-	if err := m.db.Sync2(new(edge), new(node)); err != nil {
-		return fmt.Errorf("create table edge, node: %s", err)
+	if err := m.db.Sync2(new(edge), new(node), new(symlink), new(xattr)); err != nil {
+		return fmt.Errorf("create table edge, node, symlink, xattr: %s", err)
 	}
-	if err := m.db.Sync2(new(user), new(shared)); err != nil {
-		return fmt.Errorf("create table user, shared: %s", err)
+	if err := m.db.Sync2(new(user), new(shared), new(alias), new(rekey), new(group), new(member)); err != nil {
+		return fmt.Errorf("create table user, shared, alias, rekey, group, member: %s", err)
 	}
 
 	var s = setting{Name: "format"}
@@ -219,6 +312,13 @@ func (m *dbMeta) Init(format *Format) error {
 		mustInsert(s, root)
 		shared.Inode = 2
 		shared.Mode = 0555
+		if ok, err := s.Exist(&counter{Name: "nextInode"}); err != nil {
+			return err
+		} else if !ok {
+			if err = mustInsert(s, &counter{Name: "nextInode", Value: int64(shared.Inode)}); err != nil {
+				return err
+			}
+		}
 		return mustInsert(s, &edge{Parent: 1, Name: []byte("shared"), Inode: shared.Inode, Type: TypeDirectory}, shared)
 	})
 }
@@ -233,6 +333,8 @@ func (m *dbMeta) parseAttr(n *node, attr *Attr) {
 	}
 	attr.Typ = n.Type
 	attr.Mode = n.Mode
+	attr.Uid = n.Owner
+	attr.Gid = n.Gid
 	attr.Atime = n.Atime / 1e6
 	attr.Atimensec = uint32(n.Atime%1e6*1000) + uint32(n.Atimensec)
 	attr.Mtime = n.Mtime / 1e6
@@ -252,6 +354,8 @@ func (m *dbMeta) parseNode(attr *Attr, n *node) {
 	}
 	n.Type = attr.Typ
 	n.Mode = attr.Mode
+	n.Owner = attr.Uid
+	n.Gid = attr.Gid
 	n.Atime = attr.Atime*1e6 + int64(attr.Atimensec)/1000
 	n.Mtime = attr.Mtime*1e6 + int64(attr.Mtimensec)/1000
 	n.Ctime = attr.Ctime*1e6 + int64(attr.Ctimensec)/1000
@@ -287,10 +391,23 @@ func (m *dbMeta) shouldRetry(err error) bool {
 		logger.Warnf("transaction failed: %s, will retry it. please increase the max number of connections in your database, or use a connection pool.", msg)
 		return true
 	}
-	return errors.Is(err, errBusy) || strings.Contains(msg, "database is locked")
+	return errors.Is(err, errBusy) || strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "deadlock found") || strings.Contains(msg, "try restarting transaction") ||
+		strings.Contains(msg, "could not serialize access") || strings.Contains(msg, "lock wait timeout")
+}
+
+// isDuplicate tells if err is the violation of a unique constraint, a row being inserted
+// at once by another client.
+func isDuplicate(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") || strings.Contains(msg, "duplicate key") ||
+		strings.Contains(msg, "duplicate entry")
 }
 
 func (m *dbMeta) txn(f func(s *xorm.Session) error, inodes ...Ino) error {
+	if m.readOnly {
+		return syscall.EROFS
+	}
 	start := time.Now()
 
 	inodes = []Ino{1}
@@ -310,6 +427,9 @@ func (m *dbMeta) txn(f func(s *xorm.Session) error, inodes ...Ino) error {
 		} else if err == nil && i > 1 {
 			logger.Warnf("Transaction succeeded after %d tries (%s), inodes: %v, last error: %s", i+1, time.Since(start), inodes, lastErr)
 		}
+		if err != nil && isDuplicate(err) {
+			return syscall.EEXIST
+		}
 		return err
 	}
 	logger.Warnf("Already tried 50 times, returning: %s", lastErr)
@@ -342,17 +462,151 @@ func (m *dbMeta) roTxn(f func(s *xorm.Session) error) error {
 	return lastErr
 }
 
-func (m *dbMeta) GetNextInode(ctx context.Context, lastIno *Ino) error {
-	return m.roTxn(func(s *xorm.Session) error {
+// incrCounter adds value to the counter name in the transaction s and returns its new value.
+func (m *dbMeta) incrCounter(s *xorm.Session, name string, value int64) (int64, error) {
+	if _, err := s.Incr("value", value).Where("name = ?", name).Update(&counter{}); err != nil {
+		return 0, err
+	}
+	c := counter{Name: name}
+	ok, err := s.Get(&c)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("counter %s is missing", name)
+	}
+	return c.Value, nil
+}
+
+// initCounters adds the counters to the volumes formatted before them, the inodes
+// starting after the last one.
+func (m *dbMeta) initCounters() error {
+	if err := m.db.Sync2(new(counter)); err != nil {
+		return fmt.Errorf("create table counter: %s", err)
+	}
+	err := m.txn(func(s *xorm.Session) error {
+		if ok, err := s.Exist(&counter{Name: "nextInode"}); err != nil || ok {
+			return err
+		}
 		var n node
-		if _, err := s.Desc("Inode").Get(&n); err != nil {
+		if _, err := s.Desc("inode").Get(&n); err != nil {
 			return err
 		}
-		ino := n.Inode
-		ino++
-		*lastIno = ino
-		return nil
+		return mustInsert(s, &counter{Name: "nextInode", Value: int64(n.Inode)})
 	})
+	if err == syscall.EEXIST {
+		return nil // added at once by another client
+	}
+	return err
+}
+
+// nextInode returns a new inode from the batch reserved by the client or, once it is
+// used up, from a batch reserved in the transaction s. The rest of a new batch is only
+// used once s is committed, with keepInodes.
+func (m *dbMeta) nextInode(s *xorm.Session) (Ino, *freeID, error) {
+	m.freeMu.Lock()
+	if m.freeInodes.next < m.freeInodes.maxid {
+		m.freeInodes.next++
+		ino := Ino(m.freeInodes.next)
+		m.freeMu.Unlock()
+		return ino, nil, nil
+	}
+	m.freeMu.Unlock()
+	v, err := m.incrCounter(s, "nextInode", inodeBatch)
+	if err != nil {
+		return 0, nil, err
+	}
+	batch := &freeID{next: uint64(v) - inodeBatch + 1, maxid: uint64(v)}
+	return Ino(batch.next), batch, nil
+}
+
+// keepInodes makes the batch reserved by a committed transaction the one of the client,
+// unless another create already replaced the used up one.
+func (m *dbMeta) keepInodes(batch *freeID) {
+	m.freeMu.Lock()
+	defer m.freeMu.Unlock()
+	if m.freeInodes.next >= m.freeInodes.maxid {
+		m.freeInodes = *batch
+	}
+}
+
+func (m *dbMeta) SetUser(userId uint32) {
+	m.userId = userId
+}
+
+// checkWrite returns EACCES if one of the inodes cannot be changed by the user of
+// the client: it is in a tree shared read-only with the user, or in the tree of
+// another user without being shared with it.
+func (m *dbMeta) checkWrite(s *xorm.Session, inodes ...Ino) error {
+	if m.userId == 0 {
+		return nil
+	}
+	for _, inode := range inodes {
+		ok, err := m.canWrite(s, inode, make(map[Ino]bool))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.EACCES
+		}
+	}
+	return nil
+}
+
+// canWrite returns true if the user can change the node through one of its paths, a
+// node with several links being reachable from as many directories.
+func (m *dbMeta) canWrite(s *xorm.Session, ino Ino, seen map[Ino]bool) (bool, error) {
+	if ino == RootInode || ino == SharedInode {
+		return true, nil
+	}
+	if seen[ino] {
+		return false, nil
+	}
+	seen[ino] = true
+	var shares []shared
+	// what the user shares with one of its groups stays its own
+	err := s.Where("nsfs_shared.inode = ? AND nsfs_shared.sharer != ? AND "+sharedWith, ino, m.userId, m.userId, m.userId).Find(&shares)
+	if err != nil {
+		return false, err
+	}
+	if slices.ContainsFunc(shares, func(sh shared) bool { return sh.Sharer == 0 }) {
+		owner, err := m.treeOwner(s, ino)
+		if err != nil {
+			return false, err
+		}
+		if owner == m.userId {
+			shares = nil
+		}
+	}
+	if len(shares) > 0 {
+		// shared read-write directly or with one of its groups is enough
+		return slices.ContainsFunc(shares, func(sh shared) bool { return !sh.ReadOnly }), nil
+	}
+	var edges []edge
+	if err = s.OrderBy("id").Find(&edges, &edge{Inode: ino}); err != nil {
+		return false, err
+	}
+	if len(edges) == 0 {
+		return true, nil
+	}
+	for _, e := range edges {
+		if e.Parent == RootInode {
+			// the entries of the root belong to the user who created them
+			n := node{Inode: ino}
+			ok, err := s.Get(&n)
+			if err != nil {
+				return false, err
+			}
+			if !ok || n.Owner == m.userId {
+				return true, nil
+			}
+			continue
+		}
+		if ok, err := m.canWrite(s, e.Parent, seen); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
 }
 
 func (m *dbMeta) GetUserId(username string, uid *uint32) error {
@@ -368,6 +622,19 @@ func (m *dbMeta) GetUserId(username string, uid *uint32) error {
 	})
 }
 
+func (m *dbMeta) GetUsername(uid uint32, username *string) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var u = user{Id: uid}
+		if ok, err := s.Get(&u); err != nil {
+			return err
+		} else if !ok {
+			return syscall.ENOENT
+		}
+		*username = u.Username
+		return nil
+	})
+}
+
 func (m *dbMeta) GetUserPublicKey(username string, pubKey *[]byte) error {
 	return m.roTxn(func(s *xorm.Session) error {
 		var u = user{Username: username}
@@ -395,8 +662,14 @@ func (m *dbMeta) GetAttr(ctx context.Context, inode Ino, attr *Attr) syscall.Err
 	}))
 }
 
-func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, attr *Attr) syscall.Errno {
+func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, set uint16, attr *Attr) syscall.Errno {
+	if set&(SetAttrMode|SetAttrUID|SetAttrGID) != 0 && (inode == RootInode || inode == SharedInode) {
+		return syscall.EPERM
+	}
 	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, inode); err != nil {
+			return err
+		}
 		var cur = node{Inode: inode}
 		ok, err := s.Get(&cur)
 		if err != nil {
@@ -409,7 +682,6 @@ func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, att
 		m.parseAttr(&cur, &curAttr)
 		now := time.Now()
 
-		set := uint16(in.Valid)
 		dirtyAttr, st := m.mergeAttr(ctx, set, &curAttr, attr, now)
 		if st != 0 {
 			return st
@@ -422,7 +694,7 @@ func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, att
 		m.parseNode(dirtyAttr, &dirtyNode)
 		dirtyNode.Ctime = now.UnixNano() / 1e3
 		dirtyNode.Ctimensec = int16(now.Nanosecond() % 1000)
-		_, err = s.Cols("flags", "mode", "atime", "mtime", "ctime",
+		_, err = s.Cols("flags", "mode", "owner", "gid", "length", "atime", "mtime", "ctime",
 			"atimensec", "mtimensec", "ctimensec").
 			Update(&dirtyNode, &node{Inode: inode})
 		if err == nil {
@@ -433,19 +705,43 @@ func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, att
 }
 
 func (m *dbMeta) mergeAttr(ctx context.Context, set uint16, cur, attr *Attr, now time.Time) (*Attr, syscall.Errno) {
-	// do not allow to change uid, gid or mode. Only meta attributes of time can be changed.
+	// the kernel checks the local users (default_permissions), but only the owner of the node
+	// in the volume changes its mode, owner or times, the users it is shared with cannot.
+	owner := m.userId == 0 || cur.Uid == m.userId
 	dirtyAttr := *cur
-	var uid uint32
-	if fuseCtx, ok := ctx.(*fuse.Context); ok {
-		uid = fuseCtx.Uid
-	}
 	var changed bool
+	if set&SetAttrUID != 0 && cur.Uid != attr.Uid {
+		if !owner {
+			return nil, syscall.EPERM
+		}
+		if cur.Parent == RootInode {
+			// the owner of an entry of the root decides who can see it
+			return nil, syscall.EPERM
+		}
+		dirtyAttr.Uid = attr.Uid
+		changed = true
+	}
+	if set&SetAttrGID != 0 && cur.Gid != attr.Gid {
+		if !owner {
+			return nil, syscall.EPERM
+		}
+		dirtyAttr.Gid = attr.Gid
+		changed = true
+	}
+	if set&SetAttrMode != 0 && cur.Mode != attr.Mode&07777 {
+		if !owner || cur.Typ == TypeSymlink {
+			return nil, syscall.EPERM
+		}
+		dirtyAttr.Mode = attr.Mode & 07777
+		changed = true
+	}
 	if set&SetAttrAtimeNow != 0 || (set&SetAttrAtime) != 0 && attr.Atime < 0 {
 		dirtyAttr.Atime = now.Unix()
 		dirtyAttr.Atimensec = uint32(now.Nanosecond())
 		changed = true
 	} else if set&SetAttrAtime != 0 && (cur.Atime != attr.Atime || cur.Atimensec != attr.Atimensec) {
-		if uid == 0 {
+		// setting the current time only needs write access, any other time the ownership
+		if !owner {
 			return nil, syscall.EPERM
 		}
 		dirtyAttr.Atime = attr.Atime
@@ -457,13 +753,24 @@ func (m *dbMeta) mergeAttr(ctx context.Context, set uint16, cur, attr *Attr, now
 		dirtyAttr.Mtimensec = uint32(now.Nanosecond())
 		changed = true
 	} else if set&SetAttrMtime != 0 && (cur.Mtime != attr.Mtime || cur.Mtimensec != attr.Mtimensec) {
-		if uid == 0 {
+		if !owner {
 			return nil, syscall.EPERM
 		}
 		dirtyAttr.Mtime = attr.Mtime
 		dirtyAttr.Mtimensec = attr.Mtimensec
 		changed = true
 	}
+	if set&SetAttrSize != 0 && cur.Length != attr.Length {
+		if cur.Typ != TypeFile {
+			return nil, syscall.EPERM
+		}
+		dirtyAttr.Length = attr.Length
+		if set&(SetAttrMtime|SetAttrMtimeNow) == 0 {
+			dirtyAttr.Mtime = now.Unix()
+			dirtyAttr.Mtimensec = uint32(now.Nanosecond())
+		}
+		changed = true
+	}
 	if !changed {
 		*attr = *cur
 		return nil, 0
@@ -471,68 +778,161 @@ func (m *dbMeta) mergeAttr(ctx context.Context, set uint16, cur, attr *Attr, now
 	return &dirtyAttr, 0
 }
 
-func (m *dbMeta) GetKey(ctx context.Context, inode Ino, key *[]byte) syscall.Errno {
+func (m *dbMeta) GetXattr(ctx context.Context, inode Ino, hash []byte, vbuff *[]byte) syscall.Errno {
 	return errno(m.roTxn(func(s *xorm.Session) error {
-		var e = edge{Inode: inode}
-		ok, err := s.Get(&e)
+		var x = xattr{Inode: inode, Hash: hash}
+		ok, err := s.Get(&x)
 		if err != nil {
 			return err
 		}
 		if !ok {
-			return syscall.ENOENT
+			return ENOATTR
 		}
-		*key = e.Key
+		*vbuff = x.Value
 		return nil
 	}))
 }
 
-func (m *dbMeta) GetSharedKey(ctx context.Context, userId uint32, inode Ino, key *[]byte) syscall.Errno {
+func (m *dbMeta) ListXattr(ctx context.Context, inode Ino, names *[][]byte) syscall.Errno {
 	return errno(m.roTxn(func(s *xorm.Session) error {
-		var share = shared{Inode: inode, User: userId}
-		ok, err := s.Get(&share)
+		var xs []xattr
+		if err := s.Where("inode = ?", inode).Asc("id").Find(&xs); err != nil {
+			return err
+		}
+		for _, x := range xs {
+			*names = append(*names, x.Name)
+		}
+		return nil
+	}))
+}
+
+func (m *dbMeta) SetXattr(ctx context.Context, inode Ino, hash, name, value []byte, flags uint32) syscall.Errno {
+	// every user sees the root with its own key, no other user could read its attributes
+	if inode == RootInode || inode == SharedInode {
+		return syscall.EPERM
+	}
+	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, inode); err != nil {
+			return err
+		}
+		exist, err := s.Exist(&node{Inode: inode})
 		if err != nil {
 			return err
 		}
-		if !ok {
+		if !exist {
 			return syscall.ENOENT
 		}
-		*key = share.Key
+		var x = xattr{Inode: inode, Hash: hash}
+		ok, err := s.Get(&x)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok && flags&XattrCreate != 0:
+			return syscall.EEXIST
+		case !ok && flags&XattrReplace != 0:
+			return ENOATTR
+		case ok:
+			x.Name = name
+			x.Value = value
+			_, err = s.Cols("name", "value").Update(&x, &xattr{Id: x.Id})
+		default:
+			err = mustInsert(s, &xattr{Inode: inode, Hash: hash, Name: name, Value: value})
+		}
+		return err
+	}, inode))
+}
+
+func (m *dbMeta) RemoveXattr(ctx context.Context, inode Ino, hash []byte) syscall.Errno {
+	if inode == RootInode || inode == SharedInode {
+		return syscall.EPERM
+	}
+	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, inode); err != nil {
+			return err
+		}
+		n, err := s.Delete(&xattr{Inode: inode, Hash: hash})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ENOATTR
+		}
 		return nil
-	}))
+	}, inode))
 }
 
-func (m *dbMeta) Lookup(ctx context.Context, userId uint32, parent, inode Ino, attr *Attr) syscall.Errno {
+func (m *dbMeta) Lookup(ctx context.Context, userId uint32, parent Ino, hash []byte, inode *Ino, key *[]byte, attr *Attr) syscall.Errno {
+	if len(hash) == 0 {
+		return syscall.ENOENT
+	}
 	return errno(m.roTxn(func(s *xorm.Session) error {
-		var exist bool
-		var err error
-		if parent == SharedInode {
-			var share = shared{Inode: inode, User: userId}
-			exist, err = s.Get(&share)
-		} else {
-			var edge = edge{Parent: parent, Inode: inode}
-			exist, err = s.Get(&edge)
+		var e = edge{Parent: parent, Hash: hash}
+		ok, err := s.Get(&e)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
 		}
+		var n = node{Inode: e.Inode}
+		ok, err = s.Get(&n)
 		if err != nil {
-			log.Fatalf("Failed to find nodes: %v", err)
 			return err
-		} else if !exist {
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if parent == RootInode && n.Owner != userId {
+			// every user only sees its own entries of the root
 			return syscall.ENOENT
 		}
-		var node node
-		exist, err = s.Where("inode = ?", inode).Get(&node)
+		*inode = e.Inode
+		*key = e.Key
+		m.parseAttr(&n, attr)
+		return nil
+	}))
+}
+
+func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, hash, key []byte, attr *Attr) syscall.Errno {
+	if _type == TypeSymlink {
+		return syscall.EINVAL
+	}
+	return m.mknod(ctx, parent, _type, mode, id, inode, name, hash, key, nil, attr)
+}
+
+func (m *dbMeta) Symlink(ctx context.Context, parent Ino, id uint32, inode *Ino, name, hash, key, path []byte, attr *Attr) syscall.Errno {
+	if len(path) == 0 {
+		return syscall.EINVAL
+	}
+	return m.mknod(ctx, parent, TypeSymlink, 0777, id, inode, name, hash, key, path, attr)
+}
+
+func (m *dbMeta) ReadLink(ctx context.Context, inode Ino, path *[]byte) syscall.Errno {
+	return errno(m.roTxn(func(s *xorm.Session) error {
+		var l = symlink{Inode: inode}
+		ok, err := s.Get(&l)
 		if err != nil {
-			log.Fatalf("Failed to find nodes: %v", err)
 			return err
-		} else if !exist {
+		}
+		if !ok {
 			return syscall.ENOENT
 		}
-		m.parseAttr(&node, attr)
+		*path = l.Target
 		return nil
 	}))
 }
 
-func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, key []byte, attr *Attr) syscall.Errno {
-	return errno(m.txn(func(s *xorm.Session) error {
+func (m *dbMeta) mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, hash, key, path []byte, attr *Attr) syscall.Errno {
+	if len(hash) == 0 {
+		return syscall.EINVAL
+	}
+	var batch *freeID
+	err := m.txn(func(s *xorm.Session) error {
+		batch = nil
+		if err := m.checkWrite(s, parent); err != nil {
+			return err
+		}
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
 		if err != nil {
@@ -546,7 +946,7 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 		}
 		var pattr Attr
 		m.parseAttr(&pn, &pattr)
-		var e = edge{Parent: parent, Name: name}
+		var e = edge{Parent: parent, Hash: hash}
 		ok, err = s.Get(&e)
 		if err != nil {
 			return err
@@ -557,7 +957,7 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 			foundType, foundIno = e.Type, e.Inode
 		}
 		if foundIno != 0 {
-			if _type == TypeFile || _type == TypeDirectory {
+			if _type == TypeFile || _type == TypeDirectory || _type == TypeSymlink {
 				foundNode := node{Inode: foundIno}
 				ok, err = s.Get(&foundNode)
 				if err != nil {
@@ -572,6 +972,13 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 			return syscall.EEXIST
 		}
 
+		// an inode of the batch of the client lost on failure is never reused
+		ino, newBatch, err := m.nextInode(s)
+		if err != nil {
+			return err
+		}
+		batch = newBatch
+		*inode = ino
 		n := node{Inode: *inode}
 		if attr != nil {
 			m.parseNode(attr, &n) // do almost nothing here (attr is empty)
@@ -599,20 +1006,29 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 		n.Owner = id
 		if _type == TypeDirectory {
 			n.Nlink = 2
-			n.Mode |= 0755
+			n.Mode = uint16(mode)
 			n.Length = 4 << 10 // 4KB
 			n.Type = TypeDirectory
 		} else if _type == TypeFile {
 			n.Nlink = 1
 			n.Length = 0
-			n.Mode |= 0644
+			n.Mode = uint16(mode)
 			n.Rdev = 0
 			n.Type = TypeFile
+		} else if _type == TypeSymlink {
+			n.Nlink = 1
+			n.Mode = uint16(mode) // length is the one of the clear target given in attr
+			n.Type = TypeSymlink
 		}
 
-		if err = mustInsert(s, &edge{Parent: parent, Name: name, Inode: *inode, Type: _type, Key: key}, &n); err != nil {
+		if err = mustInsert(s, &edge{Parent: parent, Name: name, Inode: *inode, Type: _type, Key: key, Hash: hash}, &n); err != nil {
 			return err
 		}
+		if _type == TypeSymlink {
+			if err = mustInsert(s, &symlink{Inode: *inode, Target: path}); err != nil {
+				return err
+			}
+		}
 		if updateParent {
 			if _, err := s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: pn.Inode}); err != nil {
 				return err
@@ -620,71 +1036,106 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 		}
 		m.parseAttr(&n, attr)
 		return nil
-	}, parent))
+	}, parent)
+	if err == nil && batch != nil {
+		m.keepInodes(batch)
+	}
+	return errno(err)
 }
 
 func (m *dbMeta) joinNodes(parent Ino, nns *[]namedNode) syscall.Errno {
 	return errno(m.roTxn(func(s *xorm.Session) error {
-		var nodes []node
-		err := s.SQL("SELECT * FROM `nsfs_edge` INNER JOIN `nsfs_node` ON nsfs_edge.inode=nsfs_node.inode WHERE nsfs_edge.parent = ?", parent).Find(&nodes)
-		if err != nil {
-			log.Fatalf("Failed to find nodes: %v", err)
-		}
-		var edges []edge
-		err = s.SQL("SELECT * FROM `nsfs_edge` INNER JOIN `nsfs_node` ON nsfs_edge.inode=nsfs_node.inode WHERE nsfs_edge.parent = ?", parent).Find(&edges)
+		// one row per edge, so that every link of a node gets its own name
+		return s.Table(&edge{}).Select("nsfs_node.*, nsfs_edge.name, nsfs_edge.key, nsfs_edge.hash").
+			Join("INNER", &node{}, "nsfs_edge.inode = nsfs_node.inode").
+			Where("nsfs_edge.parent = ?", parent).OrderBy("nsfs_edge.id").Find(nns)
+	}))
+}
+
+func (m *dbMeta) joinSharedNodes(userId uint32, nns *[]namedNode) syscall.Errno {
+	return errno(m.roTxn(func(s *xorm.Session) error {
+		// the shares with the user come before the ones with its groups
+		err := s.Table(&shared{}).Select("nsfs_node.*, nsfs_shared.name, nsfs_shared.key, nsfs_shared.read_only, "+
+			"nsfs_shared.group_id, nsfs_shared.sharer, nsfs_alias.name AS alias").
+			Join("INNER", &node{}, "nsfs_shared.inode = nsfs_node.inode").
+			Join("LEFT", &alias{}, "nsfs_alias.inode = nsfs_shared.inode AND nsfs_alias.user = ?", userId).
+			Where(sharedWith, userId, userId).OrderBy("nsfs_shared.group_id, nsfs_shared.id").Find(nns)
 		if err != nil {
-			log.Fatalf("Failed to find edges: %v", err)
-		}
-		if len(nodes) != len(edges) {
-			log.Fatalf("Nodes and edges are not equal: %d %d", len(nodes), len(edges))
+			return err
 		}
-		for _, n := range nodes {
-			nn := namedNode{node: n}
-			for _, e := range edges {
-				if e.Inode == n.Inode {
-					nn.Name = e.Name
-					nn.Key = e.Key
-					break
+		usernames := make(map[uint32]string)
+		for i := range *nns {
+			nn := &(*nns)[i]
+			if nn.Sharer == 0 {
+				if nn.Sharer, err = m.treeOwner(s, nn.Node.Inode); err != nil {
+					return err
 				}
 			}
-			*nns = append(*nns, nn)
+			if name, ok := usernames[nn.Sharer]; ok {
+				nn.Owner = name
+				continue
+			}
+			u := user{Id: nn.Sharer}
+			if _, err = s.Get(&u); err != nil {
+				return err
+			}
+			usernames[nn.Sharer] = u.Username
+			nn.Owner = u.Username
 		}
 		return nil
 	}))
 }
 
-func (m *dbMeta) joinSharedNodes(userId uint32, nns *[]namedNode) syscall.Errno {
-	return errno(m.roTxn(func(s *xorm.Session) error {
-		var nodes []node
-		err := s.SQL("SELECT * FROM `nsfs_shared` INNER JOIN `nsfs_node` ON nsfs_shared.inode=nsfs_node.inode WHERE nsfs_shared.user = ?", userId).Find(&nodes)
-		if err != nil {
-			log.Fatalf("Failed to find nodes: %v", err)
-		}
-		var shares []shared
-		err = s.SQL("SELECT * FROM `nsfs_shared` INNER JOIN `nsfs_node` ON nsfs_shared.inode=nsfs_node.inode WHERE nsfs_shared.user = ?", userId).Find(&shares)
-		if err != nil {
-			log.Fatalf("Failed to find edges: %v", err)
+// treeOwner returns the owner of the entry of the root the node is below. A node with
+// links in the trees of several users belongs to the user of the client if it is one
+// of them, else to the first one found.
+func (m *dbMeta) treeOwner(s *xorm.Session, inode Ino) (uint32, error) {
+	var owner uint32
+	seen := make(map[Ino]bool)
+	for queue := []Ino{inode}; len(queue) > 0; queue = queue[1:] {
+		ino := queue[0]
+		if ino == RootInode || seen[ino] {
+			continue
 		}
-		if len(nodes) != len(shares) {
-			log.Fatalf("Nodes and edges are not equal: %d %d", len(nodes), len(shares))
+		seen[ino] = true
+		var edges []edge
+		if err := s.OrderBy("id").Find(&edges, &edge{Inode: ino}); err != nil {
+			return 0, err
 		}
-		for _, n := range nodes {
-			nn := namedNode{node: n}
-			for _, sh := range shares {
-				if sh.Inode == n.Inode {
-					nn.Name = sh.Name
-					nn.Key = sh.Key
-					break
-				}
+		for _, e := range edges {
+			if e.Parent != RootInode {
+				queue = append(queue, e.Parent)
+				continue
+			}
+			n := node{Inode: ino}
+			if _, err := s.Get(&n); err != nil {
+				return 0, err
+			}
+			if m.userId == 0 || n.Owner == m.userId {
+				return n.Owner, nil
+			}
+			if owner == 0 {
+				owner = n.Owner
 			}
-			*nns = append(*nns, nn)
 		}
-		return nil
-	}))
+	}
+	return owner, nil
+}
+
+// checkOwner returns the owner of the tree of the node, or EACCES if it is not the user
+// of the client: only the owner shares a node, or stops sharing it.
+func (m *dbMeta) checkOwner(s *xorm.Session, inode Ino) (uint32, error) {
+	owner, err := m.treeOwner(s, inode)
+	if err != nil {
+		return 0, err
+	}
+	if m.userId != 0 && owner != m.userId {
+		return 0, syscall.EACCES
+	}
+	return owner, nil
 }
 
 func (m *dbMeta) Readdir(ctx context.Context, inode Ino, userId uint32, entries *[]*Entry) syscall.Errno {
-	// The join does not seem to work properly so doing some "brute force"
 	nodes := make([]namedNode, 0)
 	var err syscall.Errno
 	if inode == SharedInode {
@@ -692,28 +1143,75 @@ func (m *dbMeta) Readdir(ctx context.Context, inode Ino, userId uint32, entries
 	} else {
 		err = m.joinNodes(inode, &nodes)
 	}
+	// a node shared both with the user and its groups appears once, read-write if one share is
+	seen := make(map[Ino]*Entry)
 	for _, n := range nodes {
 		if len(n.Name) == 0 {
-			logger.Errorf("Corrupt entry with empty name: inode %d parent %d", n.Inode, inode)
+			logger.Errorf("Corrupt entry with empty name: inode %d parent %d", n.Node.Inode, inode)
 			continue
 		}
-		if inode == 1 && userId != n.Owner && !bytes.Equal(n.Name, []byte("shared")) {
+		if inode == 1 && userId != n.Node.Owner && !bytes.Equal(n.Name, []byte("shared")) {
 			continue
 		}
 		entry := &Entry{
-			Inode: n.Inode,
-			Name:  n.Name,
-			Key:   n.Key,
-			Attr:  &Attr{},
+			Inode:    n.Node.Inode,
+			Name:     n.Name,
+			Key:      n.Key,
+			Hash:     n.Hash,
+			Attr:     &Attr{},
+			ReadOnly: n.ReadOnly,
+			Group:    n.GroupId,
+		}
+		m.parseAttr(&n.Node, entry.Attr)
+		if inode == SharedInode {
+			entry.Owner = n.Owner
+			entry.Alias = n.Alias
+			if first, ok := seen[entry.Inode]; ok {
+				if first.ReadOnly && !entry.ReadOnly {
+					*first = *entry
+				}
+				continue
+			}
+			seen[entry.Inode] = entry
 		}
-		m.parseAttr(&n.node, entry.Attr)
 		*entries = append(*entries, entry)
 	}
 	return err
 }
 
-func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
+func (m *dbMeta) SetHash(ctx context.Context, parent Ino, name, hash []byte) syscall.Errno {
+	if len(hash) == 0 {
+		return syscall.EINVAL
+	}
+	return errno(m.txn(func(s *xorm.Session) error {
+		var e = edge{Parent: parent, Hash: hash}
+		ok, err := s.Get(&e)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if bytes.Equal(e.Name, name) {
+				return nil
+			}
+			// two entries with the same name, from before the hashes were unique
+			return syscall.EEXIST
+		}
+		n, err := s.Cols("hash").Update(&edge{Hash: hash}, &edge{Parent: parent, Name: name})
+		if err == nil && n == 0 {
+			return syscall.ENOENT
+		}
+		return err
+	}, parent))
+}
+
+func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino, hash []byte) syscall.Errno {
+	if len(hash) == 0 {
+		return syscall.EINVAL
+	}
 	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, parent); err != nil {
+			return err
+		}
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
 		if err != nil {
@@ -727,12 +1225,12 @@ func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
 		}
 		var pattr Attr
 		m.parseAttr(&pn, &pattr)
-		var e = edge{Parent: parent, Inode: inode}
+		var e = edge{Parent: parent, Hash: hash}
 		ok, err = s.Get(&e)
 		if err != nil {
 			return err
 		}
-		if !ok {
+		if !ok || e.Inode != inode {
 			return syscall.ENOENT
 		}
 		if e.Type != TypeDirectory {
@@ -757,7 +1255,7 @@ func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
 		pn.Mtimensec = int16(now % 1e3)
 		pn.Ctimensec = int16(now % 1e3)
 
-		if _, err := s.Delete(&edge{Parent: parent, Name: e.Name}); err != nil {
+		if _, err := s.Delete(&edge{Id: e.Id}); err != nil {
 			return err
 		}
 
@@ -768,14 +1266,27 @@ func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
 		if _, err := s.Delete(&shared{Inode: e.Inode}); err != nil {
 			return err
 		}
+		if _, err := s.Delete(&alias{Inode: e.Inode}); err != nil {
+			return err
+		}
+
+		if _, err := s.Delete(&xattr{Inode: e.Inode}); err != nil {
+			return err
+		}
 
 		_, err = s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: pn.Inode})
 		return err
 	}, parent))
 }
 
-func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
+func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino, hash []byte, attr *Attr) syscall.Errno {
+	if len(hash) == 0 {
+		return syscall.EINVAL
+	}
 	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, parent); err != nil {
+			return err
+		}
 		var n node
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
@@ -788,12 +1299,13 @@ func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
-		var e = edge{Parent: parent, Inode: inode}
+		// the hash of the name tells apart the links of a node in the same directory
+		var e = edge{Parent: parent, Hash: hash}
 		ok, err = s.Get(&e)
 		if err != nil {
 			return err
 		}
-		if !ok {
+		if !ok || e.Inode != inode {
 			return syscall.ENOENT
 		}
 		if e.Type == TypeDirectory {
@@ -823,10 +1335,8 @@ func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
 			updateParent = true
 		}
 
-		if _, err := s.Delete(&edge{Parent: parent, Inode: e.Inode}); err != nil {
-			return err
-		}
-		if _, err := s.Delete(&node{Inode: e.Inode}); err != nil {
+		// only this link is removed, the node goes away with the last one
+		if _, err := s.Delete(&edge{Id: e.Id}); err != nil {
 			return err
 		}
 		if updateParent {
@@ -835,17 +1345,358 @@ func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
 			}
 		}
 		if n.Nlink > 0 {
-			if _, err := s.Cols("nlink", "ctime", "ctimensec", "parent").Update(&n, &node{Inode: e.Inode}); err != nil {
+			if _, err := s.Cols("nlink", "ctime", "ctimensec").Update(&n, &node{Inode: e.Inode}); err != nil {
+				return err
+			}
+		} else {
+			if _, err := s.Delete(&node{Inode: e.Inode}); err != nil {
+				return err
+			}
+			if e.Type == TypeSymlink {
+				if _, err := s.Delete(&symlink{Inode: e.Inode}); err != nil {
+					return err
+				}
+			}
+			if _, err := s.Delete(&shared{Inode: e.Inode}); err != nil {
+				return err
+			}
+			if _, err := s.Delete(&alias{Inode: e.Inode}); err != nil {
+				return err
+			}
+			if _, err := s.Delete(&xattr{Inode: e.Inode}); err != nil {
+				return err
+			}
+			if _, err := s.Delete(&rekey{Inode: e.Inode}); err != nil {
 				return err
 			}
 		}
+		m.parseAttr(&n, attr)
 		return err
 	}, parent))
 }
 
+func (m *dbMeta) Link(ctx context.Context, inode, parent Ino, name, hash, key []byte, attr *Attr) syscall.Errno {
+	if parent == SharedInode {
+		return syscall.EPERM
+	}
+	if len(hash) == 0 {
+		return syscall.EINVAL
+	}
+	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, parent, inode); err != nil {
+			return err
+		}
+		var pn = node{Inode: parent}
+		ok, err := s.Get(&pn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if pn.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		var n = node{Inode: inode}
+		ok, err = s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if n.Type == TypeDirectory {
+			return syscall.EPERM
+		}
+		exist, err := s.Exist(&edge{Parent: parent, Hash: hash})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+
+		now := time.Now().UnixNano()
+		var updateParent bool
+		if time.Duration(now-pn.Mtime*1e3-int64(pn.Mtimensec)) >= SkipDirMtime {
+			pn.Mtime = now / 1e3
+			pn.Ctime = now / 1e3
+			pn.Mtimensec = int16(now % 1e3)
+			pn.Ctimensec = int16(now % 1e3)
+			updateParent = true
+		}
+		// the parent of a node with several links is tracked by the key of each edge
+		n.Parent = 0
+		n.Nlink++
+		n.Ctime = now / 1e3
+		n.Ctimensec = int16(now % 1e3)
+
+		if err = mustInsert(s, &edge{Parent: parent, Name: name, Inode: inode, Type: n.Type, Key: key, Hash: hash}); err != nil {
+			return err
+		}
+		if updateParent {
+			if _, err := s.Cols("mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: pn.Inode}); err != nil {
+				return err
+			}
+		}
+		if _, err := s.Cols("nlink", "ctime", "ctimensec", "parent").Update(&n, &node{Inode: inode}); err != nil {
+			return err
+		}
+		m.parseAttr(&n, attr)
+		return nil
+	}, parent))
+}
+
+func (m *dbMeta) Rename(ctx context.Context, parentSrc, inode Ino, srcHash []byte, parentDst, dstInode Ino, flags uint32, name, hash, key, dstName, dstKey []byte, attr *Attr) syscall.Errno {
+	switch flags {
+	case 0, RenameNoReplace, RenameExchange:
+	default:
+		return syscall.ENOTSUP
+	}
+	if parentSrc == SharedInode || parentDst == SharedInode || inode == SharedInode || dstInode == SharedInode {
+		return syscall.EPERM
+	}
+	if len(srcHash) == 0 || len(hash) == 0 {
+		return syscall.EINVAL
+	}
+	exchange := flags == RenameExchange
+	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, parentSrc, parentDst); err != nil {
+			return err
+		}
+		var spn = node{Inode: parentSrc}
+		ok, err := s.Get(&spn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if spn.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		var dpn = &spn
+		if parentDst != parentSrc {
+			dpn = &node{Inode: parentDst}
+			ok, err = s.Get(dpn)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return syscall.ENOENT
+			}
+			if dpn.Type != TypeDirectory {
+				return syscall.ENOTDIR
+			}
+		}
+		var se = edge{Parent: parentSrc, Hash: srcHash}
+		ok, err = s.Get(&se)
+		if err != nil {
+			return err
+		}
+		if !ok || se.Inode != inode {
+			return syscall.ENOENT
+		}
+		var sn = node{Inode: inode}
+		ok, err = s.Get(&sn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if se.Type == TypeDirectory && parentSrc != parentDst {
+			// a directory cannot be moved into its own subtree
+			if below, err := m.isBelow(s, parentDst, inode); err != nil {
+				return err
+			} else if below {
+				return syscall.EINVAL
+			}
+		}
+
+		var de edge
+		var dn node
+		var dexist bool
+		if dstInode != 0 {
+			de = edge{Parent: parentDst, Hash: hash}
+			dexist, err = s.Get(&de)
+			if err != nil {
+				return err
+			}
+			if dexist && de.Inode != dstInode {
+				return syscall.ENOENT
+			}
+		}
+		if dexist && (de.Id == se.Id || de.Inode == inode && !exchange) {
+			// both names are links to the same node, nothing is done
+			return nil
+		}
+		if dexist {
+			if flags == RenameNoReplace {
+				return syscall.EEXIST
+			}
+			dn = node{Inode: dstInode}
+			ok, err = s.Get(&dn)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return syscall.ENOENT
+			}
+			if exchange {
+				if de.Type == TypeDirectory && parentSrc != parentDst {
+					if below, err := m.isBelow(s, parentSrc, dstInode); err != nil {
+						return err
+					} else if below {
+						return syscall.EINVAL
+					}
+				}
+			} else {
+				if de.Type == TypeDirectory {
+					if se.Type != TypeDirectory {
+						return syscall.EISDIR
+					}
+					exist, err := s.Exist(&edge{Parent: dstInode})
+					if err != nil {
+						return err
+					}
+					if exist {
+						return syscall.ENOTEMPTY
+					}
+				} else if se.Type == TypeDirectory {
+					return syscall.ENOTDIR
+				}
+			}
+		} else if exchange {
+			return syscall.ENOENT
+		}
+
+		now := time.Now().UnixNano()
+		if exchange {
+			if parentSrc != parentDst && se.Type != de.Type {
+				if se.Type == TypeDirectory {
+					spn.Nlink--
+					dpn.Nlink++
+				} else if de.Type == TypeDirectory {
+					spn.Nlink++
+					dpn.Nlink--
+				}
+			}
+			if dn.Parent != 0 {
+				dn.Parent = parentSrc
+			}
+			dn.Ctime = now / 1e3
+			dn.Ctimensec = int16(now % 1e3)
+			// the entries swap their names, so do the digests of the names, one being
+			// cleared first not to have the same one twice in a directory
+			hash = de.Hash
+			if _, err := s.Table(&edge{}).ID(se.Id).Update(map[string]interface{}{"hash": nil}); err != nil {
+				return err
+			}
+			if _, err := s.Cols("parent", "name", "key", "hash").Update(&edge{Parent: parentSrc, Name: dstName, Key: dstKey, Hash: se.Hash}, &edge{Id: de.Id}); err != nil {
+				return err
+			}
+			if _, err := s.Cols("ctime", "ctimensec", "parent").Update(&dn, &node{Inode: dn.Inode}); err != nil {
+				return err
+			}
+		} else {
+			if se.Type == TypeDirectory && parentSrc != parentDst {
+				spn.Nlink--
+				dpn.Nlink++
+			}
+			if dexist {
+				if _, err := s.Delete(&edge{Id: de.Id}); err != nil {
+					return err
+				}
+				dn.Nlink--
+				if de.Type == TypeDirectory {
+					dpn.Nlink--
+					dn.Nlink = 0
+				}
+				if dn.Nlink > 0 {
+					dn.Ctime = now / 1e3
+					dn.Ctimensec = int16(now % 1e3)
+					if _, err := s.Cols("nlink", "ctime", "ctimensec").Update(&dn, &node{Inode: dn.Inode}); err != nil {
+						return err
+					}
+				} else {
+					if _, err := s.Delete(&node{Inode: dn.Inode}); err != nil {
+						return err
+					}
+					if _, err := s.Delete(&shared{Inode: dn.Inode}); err != nil {
+						return err
+					}
+					if _, err := s.Delete(&alias{Inode: dn.Inode}); err != nil {
+						return err
+					}
+					if _, err := s.Delete(&symlink{Inode: dn.Inode}); err != nil {
+						return err
+					}
+					if _, err := s.Delete(&xattr{Inode: dn.Inode}); err != nil {
+						return err
+					}
+					if _, err := s.Delete(&rekey{Inode: dn.Inode}); err != nil {
+						return err
+					}
+				}
+				m.parseAttr(&dn, attr)
+			}
+		}
+
+		if sn.Parent != 0 {
+			sn.Parent = parentDst
+		}
+		sn.Ctime = now / 1e3
+		sn.Ctimensec = int16(now % 1e3)
+		if _, err := s.Cols("parent", "name", "key", "hash").Update(&edge{Parent: parentDst, Name: name, Key: key, Hash: hash}, &edge{Id: se.Id}); err != nil {
+			return err
+		}
+		if _, err := s.Cols("ctime", "ctimensec", "parent").Update(&sn, &node{Inode: sn.Inode}); err != nil {
+			return err
+		}
+
+		spn.Mtime = now / 1e3
+		spn.Ctime = now / 1e3
+		spn.Mtimensec = int16(now % 1e3)
+		spn.Ctimensec = int16(now % 1e3)
+		if _, err := s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(&spn, &node{Inode: spn.Inode}); err != nil {
+			return err
+		}
+		if parentDst != parentSrc {
+			dpn.Mtime = now / 1e3
+			dpn.Ctime = now / 1e3
+			dpn.Mtimensec = int16(now % 1e3)
+			dpn.Ctimensec = int16(now % 1e3)
+			if _, err := s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(dpn, &node{Inode: dpn.Inode}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, parentSrc, parentDst))
+}
+
+// isBelow returns true if the directory inode is ancestor itself or one of its descendants.
+func (m *dbMeta) isBelow(s *xorm.Session, inode, ancestor Ino) (bool, error) {
+	for inode != RootInode {
+		if inode == ancestor {
+			return true, nil
+		}
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil || !ok {
+			return false, err
+		}
+		inode = n.Parent
+	}
+	return false, nil
+}
+
 func (m *dbMeta) Write(ctx context.Context, inode uint64, data []byte, off int64) syscall.Errno {
 	ino := Ino(inode)
 	return errno(m.txn(func(s *xorm.Session) error {
+		if err := m.checkWrite(s, ino); err != nil {
+			return err
+		}
 		nodeAttr := node{Inode: ino}
 		ok, err := s.Get(&nodeAttr)
 		if err != nil {
@@ -858,7 +1709,9 @@ func (m *dbMeta) Write(ctx context.Context, inode uint64, data []byte, off int64
 			return syscall.EPERM
 		}
 		newleng := uint64(len(data)) + uint64(off)
-		nodeAttr.Length = newleng
+		if newleng > nodeAttr.Length {
+			nodeAttr.Length = newleng
+		}
 		now := time.Now()
 		nodeAttr.Mtime = now.UnixNano() / 1e3
 		nodeAttr.Mtimensec = int16(now.Nanosecond() % 1e3)
@@ -975,7 +1828,7 @@ func (m *dbMeta) ChangePassword(username string, password, salt, rootKey, privKe
 	})
 }
 
-func (m *dbMeta) ShareDir(userId uint32, inode Ino, name, key []byte) error {
+func (m *dbMeta) Share(userId uint32, inode Ino, name, key []byte, readOnly bool) error {
 	return m.txn(func(s *xorm.Session) error {
 		user := user{Id: userId}
 		exist, err := s.Get(&user)
@@ -985,49 +1838,608 @@ func (m *dbMeta) ShareDir(userId uint32, inode Ino, name, key []byte) error {
 		if !exist {
 			return syscall.ENOENT
 		}
-		shared := shared{Inode: inode, Name: name, User: userId, Key: key}
+		n := node{Inode: inode}
+		exist, err = s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		if n.Type != TypeDirectory && n.Type != TypeFile {
+			return syscall.EINVAL
+		}
+		sharer, err := m.checkOwner(s, inode)
+		if err != nil {
+			return err
+		}
+		exist, err = s.Exist(&shared{Inode: inode, User: userId})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+		shared := shared{Inode: inode, Name: name, User: userId, Sharer: sharer, Key: key, ReadOnly: readOnly}
 		_, err = s.Insert(shared)
 		return err
 	})
 }
 
-func (m *dbMeta) UnshareDir(userId uint32, inode Ino) error {
+func (m *dbMeta) Unshare(userId uint32, inode Ino) error {
 	return m.txn(func(s *xorm.Session) error {
+		if _, err := m.checkOwner(s, inode); err != nil {
+			return err
+		}
 		shared := shared{Inode: inode, User: userId}
-		_, err := s.Delete(&shared)
+		n, err := s.Delete(&shared)
+		if err == nil && n == 0 {
+			return syscall.ENOENT
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) ShareGroup(groupId uint32, inode Ino, name, key []byte, readOnly bool) error {
+	return m.txn(func(s *xorm.Session) error {
+		exist, err := s.Exist(&group{Id: groupId})
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		n := node{Inode: inode}
+		exist, err = s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		if n.Type != TypeDirectory && n.Type != TypeFile {
+			return syscall.EINVAL
+		}
+		sharer, err := m.checkOwner(s, inode)
+		if err != nil {
+			return err
+		}
+		exist, err = s.Exist(&shared{Inode: inode, GroupId: groupId})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+		shared := shared{Inode: inode, Name: name, GroupId: groupId, Sharer: sharer, Key: key, ReadOnly: readOnly}
+		_, err = s.Insert(shared)
 		return err
 	})
 }
 
+func (m *dbMeta) UnshareGroup(groupId uint32, inode Ino) error {
+	return m.txn(func(s *xorm.Session) error {
+		if _, err := m.checkOwner(s, inode); err != nil {
+			return err
+		}
+		shared := shared{Inode: inode, GroupId: groupId}
+		n, err := s.Delete(&shared)
+		if err == nil && n == 0 {
+			return syscall.ENOENT
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) CreateGroup(name string, owner uint32, pubKey, privKey, secret []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		exist, err := s.Exist(&group{Name: name})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+		g := group{Name: name, Owner: owner, PubKey: pubKey, PrKey: privKey}
+		if _, err = s.Insert(&g); err != nil {
+			return err
+		}
+		return mustInsert(s, &member{GroupId: g.Id, User: owner, Secret: secret})
+	})
+}
+
+func (m *dbMeta) GetGroup(name string, groupId, owner *uint32, pubKey *[]byte) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		g := group{Name: name}
+		exist, err := s.Get(&g)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		*groupId = g.Id
+		*owner = g.Owner
+		*pubKey = g.PubKey
+		return nil
+	})
+}
+
+func (m *dbMeta) GetGroupKey(groupId, userId uint32, privKey, secret *[]byte) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		mb := member{GroupId: groupId, User: userId}
+		exist, err := s.Get(&mb)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		g := group{Id: groupId}
+		if exist, err = s.Get(&g); err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		*privKey = g.PrKey
+		*secret = mb.Secret
+		return nil
+	})
+}
+
+func (m *dbMeta) AddMember(groupId, userId uint32, secret []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		exist, err := s.Exist(&member{GroupId: groupId, User: userId})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+		return mustInsert(s, &member{GroupId: groupId, User: userId, Secret: secret})
+	})
+}
+
+func (m *dbMeta) RemoveMember(groupId, userId uint32, rekey func(*GroupKeys) error) error {
+	return m.txn(func(s *xorm.Session) error {
+		n, err := s.Delete(&member{GroupId: groupId, User: userId})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return syscall.ENOENT
+		}
+		g := group{Id: groupId}
+		exist, err := s.Get(&g)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		keys := &GroupKeys{PubKey: g.PubKey, PrKey: g.PrKey}
+		var rows []memberKey
+		err = s.Table(&member{}).Select("nsfs_member.*, nsfs_user.pub_key").
+			Join("INNER", &user{}, "nsfs_user.id = nsfs_member.user").
+			Where("nsfs_member.group_id = ?", groupId).OrderBy("nsfs_member.id").Find(&rows)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			keys.Members = append(keys.Members, &GroupMember{User: r.Member.User, PubKey: r.PubKey, Secret: r.Member.Secret})
+		}
+		var shares []shared
+		if err = s.Where("group_id = ?", groupId).OrderBy("id").Find(&shares); err != nil {
+			return err
+		}
+		for _, sh := range shares {
+			keys.Shares = append(keys.Shares, &GroupShare{id: sh.Id, Key: sh.Key})
+		}
+
+		if err = rekey(keys); err != nil {
+			return err
+		}
+		_, err = s.ID(groupId).Cols("pub_key", "pr_key").Update(&group{PubKey: keys.PubKey, PrKey: keys.PrKey})
+		if err != nil {
+			return err
+		}
+		for _, mb := range keys.Members {
+			_, err = s.Cols("secret").Update(&member{Secret: mb.Secret}, &member{GroupId: groupId, User: mb.User})
+			if err != nil {
+				return err
+			}
+		}
+		for _, sh := range keys.Shares {
+			if _, err = s.ID(sh.id).Cols("key").Update(&shared{Key: sh.Key}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) ListMembers(groupId uint32, members *[]string) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var users []user
+		err := s.Table(&user{}).Cols("nsfs_user.username").
+			Join("INNER", &member{}, "nsfs_member.user = nsfs_user.id").
+			Where("nsfs_member.group_id = ?", groupId).OrderBy("nsfs_member.id").Find(&users)
+		if err != nil {
+			return err
+		}
+		*members = nil
+		for _, u := range users {
+			*members = append(*members, u.Username)
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) SetAlias(userId uint32, inode Ino, name []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		exist, err := s.Where("nsfs_shared.inode = ? AND "+sharedWith, inode, userId, userId).Exist(&shared{})
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		if _, err = s.Delete(&alias{Inode: inode, User: userId}); err != nil {
+			return err
+		}
+		if name == nil {
+			return nil
+		}
+		return mustInsert(s, &alias{Inode: inode, User: userId, Name: name})
+	})
+}
+
+func (m *dbMeta) ListShares(userId uint32, incoming bool, shares *[]*ShareInfo) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var rows []shared
+		var err error
+		if incoming {
+			err = s.Where(sharedWith, userId, userId).OrderBy("id").Find(&rows)
+		} else {
+			// the shares older than the sharer column are filtered by the owner of their tree below
+			err = s.Where("sharer = ? OR sharer = 0", userId).OrderBy("id").Find(&rows)
+		}
+		if err != nil {
+			return err
+		}
+		usernames := make(map[uint32]string)
+		username := func(id uint32) (string, error) {
+			if name, ok := usernames[id]; ok {
+				return name, nil
+			}
+			u := user{Id: id}
+			if _, err := s.Get(&u); err != nil {
+				return "", err
+			}
+			usernames[id] = u.Username
+			return u.Username, nil
+		}
+
+		*shares = nil
+		for _, sh := range rows {
+			n := node{Inode: sh.Inode}
+			ok, err := s.Get(&n)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			info := &ShareInfo{Inode: sh.Inode, Type: n.Type, ReadOnly: sh.ReadOnly, Name: sh.Name, Key: sh.Key, Group: sh.GroupId}
+			// the tree belongs to the owner of its entry in the root
+			var owner uint32
+			for ino := sh.Inode; ino != RootInode; {
+				e := edge{Inode: ino}
+				if ok, err = s.Get(&e); err != nil {
+					return err
+				}
+				if !ok {
+					break
+				}
+				info.PathKeys = append(info.PathKeys, e.Key)
+				info.PathNames = append(info.PathNames, e.Name)
+				if e.Parent == RootInode {
+					top := node{Inode: ino}
+					if _, err = s.Get(&top); err != nil {
+						return err
+					}
+					owner = top.Owner
+				}
+				ino = e.Parent
+			}
+			if !incoming && owner != userId {
+				continue
+			}
+			if info.Owner, err = username(owner); err != nil {
+				return err
+			}
+			if sh.GroupId != 0 {
+				g := group{Id: sh.GroupId}
+				if _, err = s.Get(&g); err != nil {
+					return err
+				}
+				info.User = "group:" + g.Name
+			} else if info.User, err = username(sh.User); err != nil {
+				return err
+			}
+			*shares = append(*shares, info)
+		}
+		return nil
+	})
+}
+
 func (m *dbMeta) GetPathKey(inode Ino, keys *[][]byte) error {
 	return m.txn(func(s *xorm.Session) error {
+		var err error
+		*keys, err = m.pathKeys(s, inode)
+		return err
+	})
+}
+
+// pathKeys returns the keys of the entries from the node up to the root, each
+// encrypted by the key of the next one.
+func (m *dbMeta) pathKeys(s *xorm.Session, inode Ino) ([][]byte, error) {
+	var keys [][]byte
+	for inode != RootInode {
 		e := edge{Inode: inode}
 		exist, err := s.Get(&e)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if !exist {
-			return syscall.ENOENT
+			return nil, syscall.ENOENT
+		}
+		keys = append(keys, e.Key)
+		inode = e.Parent
+	}
+	return keys, nil
+}
+
+// rotateTries is how many times the keys of a tree are computed again when it changes
+// while they are.
+const rotateTries = 3
+
+func (m *dbMeta) RotateKeys(inode Ino, rotate func(tree []*KeyNode) error) error {
+	if inode == RootInode || inode == SharedInode {
+		return syscall.EINVAL
+	}
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	for i := 0; i < rotateTries; i++ {
+		var tree []*KeyNode
+		err := m.roTxn(func(s *xorm.Session) (err error) {
+			tree, err = m.loadKeyTree(s, inode)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// the keys are computed out of the transaction, the encryptions for the shares are slow
+		sum := keyTreeSum(tree)
+		if err = rotate(tree); err != nil {
+			return err
 		}
-		*keys = append(*keys, e.Key)
-		parent := e.Parent
-		for parent != 1 {
-			e = edge{Inode: parent}
-			exist, err = s.Get(&e)
+		var changed bool
+		err = m.txn(func(s *xorm.Session) error {
+			current, err := m.loadKeyTree(s, inode)
 			if err != nil {
 				return err
 			}
-			if !exist {
-				return syscall.ENOENT
+			if changed = !bytes.Equal(keyTreeSum(current), sum); changed {
+				return nil
 			}
-			*keys = append(*keys, e.Key)
-			parent = e.Parent
+			return m.saveKeyTree(s, tree)
+		})
+		if err != nil || !changed {
+			return err
+		}
+		logger.Debugf("Tree of inode %d changed during the rotation of its keys (tried %d)", inode, i+1)
+	}
+	return syscall.EAGAIN
+}
+
+// keyTreeSum returns a digest of everything a rotation reads in a tree, to tell if it
+// changed since it was loaded.
+func keyTreeSum(tree []*KeyNode) []byte {
+	h := sha512.New()
+	for _, kn := range tree {
+		fmt.Fprintf(h, "node %d %d %d %t %q\n", kn.Inode, kn.Type, kn.Length, kn.Pending, kn.Target)
+		for _, e := range kn.Edges {
+			fmt.Fprintf(h, "edge %d %d %q %q %q %q\n", e.id, e.Parent, e.Name, e.Hash, e.Key, e.ParentKeys)
 		}
+		for _, x := range kn.Xattrs {
+			fmt.Fprintf(h, "xattr %d %q %q %q\n", x.id, x.Hash, x.Name, x.Value)
+		}
+		for _, sh := range kn.Shares {
+			fmt.Fprintf(h, "share %d %d %d %q %q %q\n", sh.id, sh.User, sh.Group, sh.PubKey, sh.Name, sh.Key)
+		}
+		for _, a := range kn.Aliases {
+			fmt.Fprintf(h, "alias %d %q\n", a.id, a.Name)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// loadKeyTree returns the nodes below inode, each one after the directory it was found in.
+func (m *dbMeta) loadKeyTree(s *xorm.Session, inode Ino) ([]*KeyNode, error) {
+	var tree []*KeyNode
+	seen := map[Ino]bool{inode: true}
+	for queue := []Ino{inode}; len(queue) > 0; queue = queue[1:] {
+		n := node{Inode: queue[0]}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		kn := &KeyNode{Inode: n.Inode, Type: n.Type, Length: n.Length}
+		tree = append(tree, kn)
+
+		var edges []edge
+		if err = s.Where("inode = ?", n.Inode).OrderBy("id").Find(&edges); err != nil {
+			return nil, err
+		}
+		for _, e := range edges {
+			kn.Edges = append(kn.Edges, &KeyEdge{id: e.Id, Parent: e.Parent, Name: e.Name, Hash: e.Hash, Key: e.Key})
+		}
+		var xattrs []xattr
+		if err = s.Find(&xattrs, &xattr{Inode: n.Inode}); err != nil {
+			return nil, err
+		}
+		for _, x := range xattrs {
+			kn.Xattrs = append(kn.Xattrs, &KeyXattr{id: x.Id, Hash: x.Hash, Name: x.Name, Value: x.Value})
+		}
+		if n.Type == TypeSymlink {
+			sl := symlink{Inode: n.Inode}
+			if _, err = s.Get(&sl); err != nil {
+				return nil, err
+			}
+			kn.Target = sl.Target
+		}
+		var shares []shared
+		if err = s.Find(&shares, &shared{Inode: n.Inode}); err != nil {
+			return nil, err
+		}
+		for _, sh := range shares {
+			ks := &KeyShare{id: sh.Id, User: sh.User, Group: sh.GroupId, Name: sh.Name, Key: sh.Key}
+			if sh.GroupId != 0 {
+				g := group{Id: sh.GroupId}
+				if _, err = s.Get(&g); err != nil {
+					return nil, err
+				}
+				ks.PubKey = g.PubKey
+			} else {
+				u := user{Id: sh.User}
+				if _, err = s.Get(&u); err != nil {
+					return nil, err
+				}
+				ks.PubKey = u.PubKey
+			}
+			kn.Shares = append(kn.Shares, ks)
+		}
+		var aliases []alias
+		if err = s.Find(&aliases, &alias{Inode: n.Inode}); err != nil {
+			return nil, err
+		}
+		for _, a := range aliases {
+			kn.Aliases = append(kn.Aliases, &KeyAlias{id: a.Id, Name: a.Name})
+		}
+		if kn.Pending, err = s.Exist(&rekey{Inode: n.Inode}); err != nil {
+			return nil, err
+		}
+
+		if n.Type == TypeDirectory {
+			var children []edge
+			if err = s.Where("parent = ?", n.Inode).OrderBy("id").Find(&children); err != nil {
+				return nil, err
+			}
+			for _, c := range children {
+				if !seen[c.Inode] {
+					seen[c.Inode] = true
+					queue = append(queue, c.Inode)
+				}
+			}
+		}
+	}
+	// the keys of the parents out of the tree do not change, but the entries are encrypted again
+	for _, kn := range tree {
+		for _, e := range kn.Edges {
+			if !seen[e.Parent] {
+				keys, err := m.pathKeys(s, e.Parent)
+				if err != nil {
+					return nil, err
+				}
+				e.ParentKeys = keys
+			}
+		}
+	}
+	return tree, nil
+}
+
+func (m *dbMeta) saveKeyTree(s *xorm.Session, tree []*KeyNode) error {
+	for _, kn := range tree {
+		for _, e := range kn.Edges {
+			if _, err := s.Cols("name", "hash", "key").Update(&edge{Name: e.Name, Hash: e.Hash, Key: e.Key}, &edge{Id: e.id}); err != nil {
+				return err
+			}
+		}
+		for _, x := range kn.Xattrs {
+			if _, err := s.Cols("hash", "name", "value").Update(&xattr{Hash: x.Hash, Name: x.Name, Value: x.Value}, &xattr{Id: x.id}); err != nil {
+				return err
+			}
+		}
+		if kn.Type == TypeSymlink {
+			if _, err := s.Cols("target").Update(&symlink{Target: kn.Target}, &symlink{Inode: kn.Inode}); err != nil {
+				return err
+			}
+		}
+		for _, sh := range kn.Shares {
+			if _, err := s.Cols("name", "key").Update(&shared{Name: sh.Name, Key: sh.Key}, &shared{Id: sh.id}); err != nil {
+				return err
+			}
+		}
+		for _, a := range kn.Aliases {
+			if _, err := s.Cols("name").Update(&alias{Name: a.Name}, &alias{Id: a.id}); err != nil {
+				return err
+			}
+		}
+		if kn.Rekey != nil {
+			if _, err := s.Delete(&rekey{Inode: kn.Inode}); err != nil {
+				return err
+			}
+			if err := mustInsert(s, &rekey{Inode: kn.Inode, Key: kn.Rekey}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) GetRekey(inode Ino, key *[]byte) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		r := rekey{Inode: inode}
+		exist, err := s.Get(&r)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		*key = r.Key
 		return nil
 	})
 }
 
-func newSQLMeta(driver, addr string) (Meta, error) {
+func (m *dbMeta) ListRekeys(inodes *[]Ino) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var rekeys []rekey
+		if err := s.Cols("inode").Find(&rekeys); err != nil {
+			return err
+		}
+		*inodes = nil
+		for _, r := range rekeys {
+			*inodes = append(*inodes, r.Inode)
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) DoneRekey(inode Ino) error {
+	return m.txn(func(s *xorm.Session) error {
+		_, err := s.Delete(&rekey{Inode: inode})
+		return err
+	})
+}
+
+func newSQLMeta(driver, addr string, readOnly bool) (Meta, error) {
 	engine, err := xorm.NewEngine(driver, addr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to use data source %s: %s", driver, err)
@@ -1044,9 +2456,10 @@ func newSQLMeta(driver, addr string) (Meta, error) {
 	engine.DB().SetConnMaxIdleTime(time.Minute * 5)
 	engine.SetTableMapper(names.NewPrefixMapper(engine.GetTableMapper(), "nsfs_"))
 	m := &dbMeta{
-		db:   engine,
-		addr: addr,
-		root: RootInode,
+		db:       engine,
+		addr:     addr,
+		root:     RootInode,
+		readOnly: readOnly,
 	}
 	return m, nil
 }
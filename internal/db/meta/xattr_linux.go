@@ -0,0 +1,5 @@
+package meta
+
+import "syscall"
+
+const ENOATTR = syscall.ENODATA
@@ -3,9 +3,16 @@ package object
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/bastienvty/netsecfs/utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"xorm.io/xorm"
 	"xorm.io/xorm/log"
@@ -19,41 +26,39 @@ type dbData struct {
 
 func (s *dbData) String() string {
 	driver := s.db.DriverName()
-	return fmt.Sprintf("%s://%s/", driver, s.addr)
+	return fmt.Sprintf("%s://%s/", driver, utils.StripUserinfo(s.addr))
 }
 
 type blob struct {
 	Inode    uint64    `xorm:"pk"`
+	Indx     uint32    `xorm:"pk"`
 	Key      []byte    `xorm:"notnull"`
 	Size     int64     `xorm:"notnull"`
 	Modified time.Time `xorm:"notnull updated"`
 	Data     []byte    `xorm:"mediumblob"`
 }
 
-func (s *dbData) Get(inode uint64, off int64, key *[]byte) ([]byte, error) {
-	var b = blob{Inode: inode}
-	ok, err := s.db.Get(&b)
+func (s *dbData) Get(inode uint64, indx uint32, key *[]byte) ([]byte, error) {
+	var b blob
+	ok, err := s.db.Where("inode = ? AND indx = ?", inode, indx).Get(&b)
 	if err != nil {
 		return nil, err
 	}
 	if !ok {
 		return nil, os.ErrNotExist
 	}
-	if off > int64(len(b.Data)) {
-		off = int64(len(b.Data))
-	}
-	data := b.Data[off:]
 	*key = b.Key
-	return data, nil
+	return b.Data, nil
 }
 
-func (s *dbData) Put(inode uint64, key []byte, data []byte, size int64) error {
+func (s *dbData) Put(inode uint64, indx uint32, key []byte, data []byte, size int64) error {
 	now := time.Now()
-	// size of clear data (not encrypted) -> TODO: update length of encrypted data
-	b := blob{Inode: inode, Key: key, Data: data, Size: size, Modified: now}
+	// size of clear data (not encrypted)
+	b := blob{Inode: inode, Indx: indx, Key: key, Data: data, Size: size, Modified: now}
 	n, err := s.db.Insert(&b)
 	if err != nil || n == 0 {
-		n, err = s.db.Update(&b, &blob{Inode: inode})
+		n, err = s.db.Cols("key", "size", "modified", "data").
+			Where("inode = ? AND indx = ?", inode, indx).Update(&b)
 	}
 	if err == nil && n == 0 {
 		err = errors.New("not inserted or updated")
@@ -61,18 +66,15 @@ func (s *dbData) Put(inode uint64, key []byte, data []byte, size int64) error {
 	return err
 }
 
-func (s *dbData) Delete(inode uint64, key string) error {
-	affected, err := s.db.Delete(&blob{Inode: inode})
-	if err == nil && affected == 0 {
-		return nil
-	}
+func (s *dbData) Delete(inode uint64, indx uint32) error {
+	_, err := s.db.Where("inode = ? AND indx >= ?", inode, indx).Delete(&blob{})
 	return err
 }
 
-func newSQLStore(driver, addr string) (ObjectStorage, error) {
+func newSQLStore(driver, addr string, readOnly bool) (ObjectStorage, error) {
 	engine, err := xorm.NewEngine(driver, addr)
 	if err != nil {
-		return nil, fmt.Errorf("open %s: %s", addr, err)
+		return nil, fmt.Errorf("open %s: %s", utils.StripUserinfo(addr), err)
 	}
 	switch logger.Level { // make xorm less verbose
 	case logrus.TraceLevel:
@@ -87,12 +89,78 @@ func newSQLStore(driver, addr string) (ObjectStorage, error) {
 		engine.SetLogLevel(log.LOG_OFF)
 	}
 	engine.SetTableMapper(names.NewPrefixMapper(engine.GetTableMapper(), "nsfs_"))
+	if err := checkBlobTable(engine); err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return &dbData{engine, addr}, nil
+	}
 	if err := engine.Sync2(new(blob)); err != nil {
 		return nil, fmt.Errorf("create table blob: %s", err)
 	}
 	return &dbData{engine, addr}, nil
 }
 
-func CreateStorage(addr string) (ObjectStorage, error) {
-	return newSQLStore("sqlite3", addr)
+// checkBlobTable refuses the table of the versions keeping each file in a single blob,
+// keyed by its inode only: Sync2 does not change a primary key, and such a blob, encrypted
+// as a whole, cannot be split into blocks without the key of its file.
+func checkBlobTable(engine *xorm.Engine) error {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return fmt.Errorf("read tables: %s", err)
+	}
+	name := engine.TableName(new(blob))
+	for _, t := range tables {
+		if t.Name == name && !slices.Contains(t.PrimaryKeys, "indx") {
+			return fmt.Errorf("table %s is of a version without blocks, its files have to be copied to a new volume", name)
+		}
+	}
+	return nil
+}
+
+// The credentials of the storage are not saved with the volume, every client gets them
+// from these variables when the address has none.
+const (
+	envStorageUser     = "NETSECFS_STORAGE_USER"
+	envStoragePassword = "NETSECFS_STORAGE_PASSWORD"
+)
+
+// withCredentials adds the user and the password of the environment to the URL of a
+// database without any.
+func withCredentials(addr string) string {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	user, password := os.Getenv(envStorageUser), os.Getenv(envStoragePassword)
+	if !ok || user == "" && password == "" || utils.StripUserinfo(addr) != addr {
+		return addr
+	}
+	userinfo := url.UserPassword(user, password).String()
+	if scheme == "mysql" {
+		// a MySQL data source name is not escaped
+		userinfo = user + ":" + password
+	}
+	return scheme + "://" + userinfo + "@" + rest
+}
+
+// CreateStorage returns the object storage for the given address, the backend
+// being chosen from the scheme: `file://` for a local directory, `s3://` for an
+// S3-compatible service and a SQL database otherwise. When readOnly, nothing is
+// created and any change fails with EROFS.
+func CreateStorage(addr string, readOnly bool) (ObjectStorage, error) {
+	var o ObjectStorage
+	var err error
+	if dir, ok := strings.CutPrefix(addr, "file://"); ok {
+		o, err = newDisk(dir, readOnly)
+	} else if strings.HasPrefix(addr, "s3://") {
+		o, err = newS3(addr, readOnly)
+	} else {
+		driver, dsn := utils.ParseDataSource(withCredentials(addr))
+		if readOnly {
+			dsn = utils.ReadOnlyDataSource(driver, dsn)
+		}
+		o, err = newSQLStore(driver, dsn, readOnly)
+	}
+	if err != nil || !readOnly {
+		return o, err
+	}
+	return readOnlyStore{o}, nil
 }
@@ -0,0 +1,101 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// diskStore keeps every block in its own file, under a directory per inode.
+type diskStore struct {
+	root string
+}
+
+func (d *diskStore) String() string {
+	return fmt.Sprintf("file://%s/", d.root)
+}
+
+func (d *diskStore) path(inode uint64, indx uint32) string {
+	return filepath.Join(d.root, filepath.FromSlash(blockName(inode, indx)))
+}
+
+func (d *diskStore) Get(inode uint64, indx uint32, key *[]byte) ([]byte, error) {
+	buf, err := os.ReadFile(d.path(inode, indx))
+	if errors.Is(err, iofs.ErrNotExist) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(buf, key)
+}
+
+func (d *diskStore) Put(inode uint64, indx uint32, key []byte, data []byte, size int64) error {
+	p := d.path(inode, indx)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	// write aside and rename, so that a block is never read half written, each
+	// writer with a file of its own
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(encodeBlock(key, data))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *diskStore) Delete(inode uint64, indx uint32) error {
+	dir := filepath.Join(d.root, strconv.FormatUint(inode, 10))
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		i, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil || uint32(i) < indx {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, iofs.ErrNotExist) {
+			return err
+		}
+	}
+	if indx == 0 {
+		// the directory is kept if something was left in it
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+func newDisk(root string, readOnly bool) (ObjectStorage, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("absolute path of %s: %s", root, err)
+	}
+	if readOnly {
+		if _, err = os.Stat(root); err != nil {
+			return nil, err
+		}
+		return &diskStore{root: root}, nil
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("create directory %s: %s", root, err)
+	}
+	return &diskStore{root: root}, nil
+}
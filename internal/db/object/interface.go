@@ -1,6 +1,10 @@
 package object
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
 	"time"
 
 	"github.com/bastienvty/netsecfs/utils"
@@ -37,12 +41,12 @@ func (o *obj) StorageClass() string { return o.sc }
 type ObjectStorage interface {
 	// Description of the object storage.
 	String() string
-	// Get the data for the given object specified by key.
-	Get(inode uint64, off int64, key *[]byte) ([]byte, error)
-	// Put data read from a reader to an object specified by key.
-	Put(inode uint64, key []byte, data []byte, size int64) error
-	// Delete a object.
-	Delete(inode uint64, key string) error
+	// Get the data of the block indx of the given inode, along with its key.
+	Get(inode uint64, indx uint32, key *[]byte) ([]byte, error)
+	// Put the data of the block indx of the given inode.
+	Put(inode uint64, indx uint32, key []byte, data []byte, size int64) error
+	// Delete all the blocks of the given inode starting at indx.
+	Delete(inode uint64, indx uint32) error
 }
 
 type Shutdownable interface {
@@ -54,3 +58,47 @@ func Shutdown(o ObjectStorage) {
 		s.Shutdown()
 	}
 }
+
+// readOnlyStore refuses to change the blocks of the storage it wraps.
+type readOnlyStore struct {
+	ObjectStorage
+}
+
+func (s readOnlyStore) Put(inode uint64, indx uint32, key []byte, data []byte, size int64) error {
+	return syscall.EROFS
+}
+
+func (s readOnlyStore) Delete(inode uint64, indx uint32) error {
+	return syscall.EROFS
+}
+
+func (s readOnlyStore) Shutdown() {
+	Shutdown(s.ObjectStorage)
+}
+
+// blockName is the name of the object holding the block indx of the given inode.
+func blockName(inode uint64, indx uint32) string {
+	return fmt.Sprintf("%d/%d", inode, indx)
+}
+
+// encodeBlock prepends the wrapped content key to the encrypted data, so that
+// backends without columns can store a block as a single object.
+func encodeBlock(key, data []byte) []byte {
+	buf := make([]byte, 2+len(key)+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(key)))
+	copy(buf[2:], key)
+	copy(buf[2+len(key):], data)
+	return buf
+}
+
+func decodeBlock(buf []byte, key *[]byte) ([]byte, error) {
+	if len(buf) < 2 {
+		return nil, errors.New("block too short")
+	}
+	size := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+size {
+		return nil, errors.New("block key truncated")
+	}
+	*key = buf[2 : 2+size]
+	return buf[2+size:], nil
+}
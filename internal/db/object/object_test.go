@@ -0,0 +1,325 @@
+package object
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// testStorage checks the blocks of a storage are kept with their key, replaced and deleted.
+func testStorage(t *testing.T, o ObjectStorage) {
+	t.Helper()
+	blocks := []struct {
+		inode uint64
+		indx  uint32
+	}{{1, 0}, {1, 1}, {1, 2}, {1, 10}, {2, 0}}
+	for _, b := range blocks {
+		key := []byte(fmt.Sprintf("key-%d-%d", b.inode, b.indx))
+		data := []byte(fmt.Sprintf("data-%d-%d", b.inode, b.indx))
+		if err := o.Put(b.inode, b.indx, key, data, int64(len(data))); err != nil {
+			t.Fatalf("put %d/%d: %s", b.inode, b.indx, err)
+		}
+	}
+	get := func(inode uint64, indx uint32) (string, string, error) {
+		var key []byte
+		data, err := o.Get(inode, indx, &key)
+		return string(key), string(data), err
+	}
+	for _, b := range blocks {
+		key, data, err := get(b.inode, b.indx)
+		if err != nil {
+			t.Fatalf("get %d/%d: %s", b.inode, b.indx, err)
+		}
+		if want := fmt.Sprintf("key-%d-%d", b.inode, b.indx); key != want {
+			t.Errorf("get %d/%d: key %q, want %q", b.inode, b.indx, key, want)
+		}
+		if want := fmt.Sprintf("data-%d-%d", b.inode, b.indx); data != want {
+			t.Errorf("get %d/%d: data %q, want %q", b.inode, b.indx, data, want)
+		}
+	}
+	if _, _, err := get(3, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get missing block: got %v, want ErrNotExist", err)
+	}
+
+	if err := o.Put(1, 1, []byte("new key"), []byte("new data"), 8); err != nil {
+		t.Fatalf("replace 1/1: %s", err)
+	}
+	if key, data, err := get(1, 1); err != nil || key != "new key" || data != "new data" {
+		t.Errorf("get replaced 1/1: %q, %q, %v", key, data, err)
+	}
+
+	// from the second block on
+	if err := o.Delete(1, 1); err != nil {
+		t.Fatalf("delete 1 from 1: %s", err)
+	}
+	if _, _, err := get(1, 0); err != nil {
+		t.Errorf("get 1/0 kept: %s", err)
+	}
+	for _, indx := range []uint32{1, 2, 10} {
+		if _, _, err := get(1, indx); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("get deleted 1/%d: got %v, want ErrNotExist", indx, err)
+		}
+	}
+	if err := o.Delete(1, 0); err != nil {
+		t.Fatalf("delete 1: %s", err)
+	}
+	if _, _, err := get(1, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get deleted 1/0: got %v, want ErrNotExist", err)
+	}
+	if _, data, err := get(2, 0); err != nil || data != "data-2-0" {
+		t.Errorf("get 2/0 of another inode: %q, %v", data, err)
+	}
+	if err := o.Delete(3, 0); err != nil {
+		t.Errorf("delete missing inode: %s", err)
+	}
+}
+
+// testReadOnly checks a storage opened read-only gives the blocks, without changing them.
+func testReadOnly(t *testing.T, addr string) {
+	t.Helper()
+	o, err := CreateStorage(addr, true)
+	if err != nil {
+		t.Fatalf("open %s read-only: %s", addr, err)
+	}
+	defer Shutdown(o)
+	var key []byte
+	if data, err := o.Get(2, 0, &key); err != nil || string(data) != "data-2-0" {
+		t.Errorf("get 2/0 read-only: %q, %v", data, err)
+	}
+	if err := o.Put(2, 0, key, []byte("changed"), 7); err != syscall.EROFS {
+		t.Errorf("put read-only: got %v, want EROFS", err)
+	}
+	if err := o.Delete(2, 0); err != syscall.EROFS {
+		t.Errorf("delete read-only: got %v, want EROFS", err)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	addr := "file://" + filepath.Join(t.TempDir(), "blocks")
+	o, err := CreateStorage(addr, false)
+	if err != nil {
+		t.Fatalf("create %s: %s", addr, err)
+	}
+	testStorage(t, o)
+	testReadOnly(t, addr)
+}
+
+func TestDiskStoreConcurrentPut(t *testing.T) {
+	dir := t.TempDir()
+	o, err := CreateStorage("file://"+dir, false)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, 64<<10)
+			for j := 0; j < 10; j++ {
+				if err := o.Put(1, 0, []byte{byte(i)}, data, int64(len(data))); err != nil {
+					t.Errorf("put: %s", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	var key []byte
+	data, err := o.Get(1, 0, &key)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	// the block is the one of a single writer
+	if len(key) != 1 || !bytes.Equal(data, bytes.Repeat([]byte{'a' + key[0]}, 64<<10)) {
+		t.Errorf("block mixes the writes of several writers")
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "1"))
+	if err != nil {
+		t.Fatalf("read dir: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left: %d entries", len(entries))
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "data.db")
+	o, err := CreateStorage(addr, false)
+	if err != nil {
+		t.Fatalf("create %s: %s", addr, err)
+	}
+	defer Shutdown(o)
+	testStorage(t, o)
+	testReadOnly(t, addr)
+}
+
+func TestSQLStoreWithoutBlocks(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "data.db")
+	engine, err := xorm.NewEngine("sqlite3", addr)
+	if err != nil {
+		t.Fatalf("open %s: %s", addr, err)
+	}
+	// the table of the versions keeping a file in a single blob
+	_, err = engine.Exec(`CREATE TABLE nsfs_blob (inode INTEGER PRIMARY KEY, "key" BLOB NOT NULL,
+		size INTEGER NOT NULL, modified DATETIME NOT NULL, data BLOB)`)
+	engine.Close()
+	if err != nil {
+		t.Fatalf("create table: %s", err)
+	}
+	for _, readOnly := range []bool{false, true} {
+		if o, err := CreateStorage(addr, readOnly); err == nil || !strings.Contains(err.Error(), "without blocks") {
+			if err == nil {
+				Shutdown(o)
+			}
+			t.Errorf("create storage of an older version (read-only %v): got %v, want an error", readOnly, err)
+		}
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	// anonymous requests, not to depend on the credentials of the environment
+	t.Setenv(envStorageUser, "")
+	t.Setenv(envStoragePassword, "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "none"))
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	addr := "s3://" + strings.TrimPrefix(srv.URL, "http://") + "/nsfs/vol?secure=false&region=us-east-1"
+	o, err := CreateStorage(addr, false)
+	if err != nil {
+		t.Fatalf("create %s: %s", addr, err)
+	}
+	if !fake.buckets["nsfs"] {
+		t.Fatalf("bucket not created")
+	}
+	testStorage(t, o)
+	for name := range fake.objects {
+		if !strings.HasPrefix(name, "nsfs/vol/") {
+			t.Errorf("object %s outside of the prefix", name)
+		}
+	}
+	testReadOnly(t, addr)
+}
+
+// fakeS3 serves the few requests of the S3 API the storage makes, with buckets and
+// objects in memory.
+type fakeS3 struct {
+	sync.Mutex
+	buckets map[string]bool
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: make(map[string]bool), objects: make(map[string][]byte)}
+}
+
+type listResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []listObject
+}
+
+type listObject struct {
+	Key          string
+	Size         int
+	LastModified string
+	ETag         string
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			if !f.buckets[bucket] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			f.buckets[bucket] = true
+		case http.MethodGet:
+			f.list(w, bucket, r.URL.Query().Get("prefix"))
+		default:
+			f.error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+	if !f.buckets[bucket] {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	name := bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[name] = data
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[name]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	res := listResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	for name, data := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			res.Contents = append(res.Contents, listObject{
+				Key:          key,
+				Size:         len(data),
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+				ETag:         `"etag"`,
+			})
+		}
+	}
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+	res.KeyCount = len(res.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
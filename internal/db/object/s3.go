@@ -0,0 +1,124 @@
+package object
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bastienvty/netsecfs/utils"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Store keeps every block as an object of a bucket of any S3-compatible service.
+type s3Store struct {
+	client   *minio.Client
+	endpoint string
+	bucket   string
+	prefix   string
+}
+
+func (s *s3Store) String() string {
+	return fmt.Sprintf("s3://%s/%s/%s", s.endpoint, s.bucket, s.prefix)
+}
+
+func (s *s3Store) Get(inode uint64, indx uint32, key *[]byte) ([]byte, error) {
+	ctx := context.Background()
+	o, err := s.client.GetObject(ctx, s.bucket, s.prefix+blockName(inode, indx), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+	buf, err := io.ReadAll(o)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return decodeBlock(buf, key)
+}
+
+func (s *s3Store) Put(inode uint64, indx uint32, key []byte, data []byte, size int64) error {
+	buf := encodeBlock(key, data)
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.prefix+blockName(inode, indx),
+		bytes.NewReader(buf), int64(len(buf)), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (s *s3Store) Delete(inode uint64, indx uint32) error {
+	ctx := context.Background()
+	dir := s.prefix + strconv.FormatUint(inode, 10) + "/"
+	for o := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: dir}) {
+		if o.Err != nil {
+			return o.Err
+		}
+		i, err := strconv.ParseUint(strings.TrimPrefix(o.Key, dir), 10, 32)
+		if err != nil || uint32(i) < indx {
+			continue
+		}
+		if err := s.client.RemoveObject(ctx, s.bucket, o.Key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newS3 connects to an address like s3://access:secret@host:port/bucket/prefix?secure=false&region=us-east-1.
+// Without credentials in the address, as saved with the volume, they are read from NETSECFS_STORAGE_USER
+// and NETSECFS_STORAGE_PASSWORD, the usual AWS environment variables or the AWS credentials file.
+func newS3(addr string, readOnly bool) (ObjectStorage, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", utils.StripUserinfo(addr), err)
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Host == "" || bucket == "" {
+		return nil, fmt.Errorf("invalid address %s, expected s3://host/bucket", utils.StripUserinfo(addr))
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.Static{Value: credentials.Value{
+			AccessKeyID:     os.Getenv(envStorageUser),
+			SecretAccessKey: os.Getenv(envStoragePassword),
+			SignerType:      credentials.SignatureV4,
+		}},
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+	})
+	if u.User != nil {
+		secret, _ := u.User.Password()
+		creds = credentials.NewStaticV4(u.User.Username(), secret, "")
+	}
+	query := u.Query()
+	secure := query.Get("secure") != "false"
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: query.Get("region"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %s", u.Host, err)
+	}
+	ctx := context.Background()
+	exist, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("check bucket %s: %s", bucket, err)
+	}
+	if !exist && readOnly {
+		return nil, fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	if !exist {
+		if err = client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: query.Get("region")}); err != nil {
+			return nil, fmt.Errorf("create bucket %s: %s", bucket, err)
+		}
+	}
+	return &s3Store{client: client, endpoint: u.Host, bucket: bucket, prefix: prefix}, nil
+}
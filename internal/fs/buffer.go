@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/utils"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+var logger = utils.GetLogger("juicefs")
+
+// dirtyLimit is the size of the blocks a file keeps in its write-back buffer
+// before uploading them.
+const dirtyLimit = 8 << 20
+
+// writeBuffer keeps the blocks written to a file until they are encrypted and
+// uploaded, on flush, fsync or release, or when they exceed dirtyLimit. It is
+// shared by all the open handles of the file.
+type writeBuffer struct {
+	sync.Mutex
+	blocks map[uint32][]byte // clear content of the blocks not uploaded yet
+	size   int               // bytes held in blocks
+	end    uint64            // end of the last byte written, not saved in meta yet
+	dirty  bool              // the length and mtime are not saved in meta yet
+	saved  uint64            // length in meta, as of the last open, setattr, flush or read at the end
+}
+
+// length returns the length of the file with the writes not saved yet.
+func (b *writeBuffer) length(saved uint64) uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return max(saved, b.end)
+}
+
+// put replaces the content of the block indx.
+func (b *writeBuffer) put(indx uint32, block []byte) {
+	if b.blocks == nil {
+		b.blocks = make(map[uint32][]byte)
+	}
+	b.size += len(block) - len(b.blocks[indx])
+	b.blocks[indx] = block
+}
+
+// discard drops the writes not saved yet, of a file that was removed.
+func (b *writeBuffer) discard() {
+	b.Lock()
+	defer b.Unlock()
+	b.blocks = nil
+	b.size = 0
+	b.end = 0
+	b.dirty = false
+	b.saved = 0
+}
+
+// flush uploads the blocks of the write-back buffer, then saves the length and
+// mtime of the file. The buffer must be locked. The blocks that fail to be
+// uploaded are kept to be tried again, and EIO is returned.
+func (n *Node) flush(ctx context.Context) syscall.Errno {
+	b := n.buf
+	ino := n.StableAttr().Ino
+	if len(b.blocks) > 0 {
+		// the key is found again, the one of the lookup may have been rotated since
+		key, errno := n.reloadKey(ctx)
+		if errno == 0 {
+			errno = n.upload(key)
+		}
+		// rotated while uploading: the re-encryption of the file may have missed the blocks
+		if again, e := n.reloadKey(ctx); errno == 0 && e == 0 && !bytes.Equal(again, key) {
+			errno = n.upload(again)
+		}
+		if errno != 0 {
+			return errno
+		}
+		b.blocks = nil
+		b.size = 0
+	}
+	if !b.dirty {
+		return 0
+	}
+	// an empty write at the end of the data updates the length
+	err := n.meta.Write(ctx, ino, nil, int64(b.end))
+	if err == syscall.ENOENT {
+		// removed while it was open, nothing must be left in the storage
+		err = fs.ToErrno(n.obj.Delete(ino, 0))
+	}
+	if err != 0 {
+		return err
+	}
+	b.saved = max(b.saved, b.end)
+	b.end = 0
+	b.dirty = false
+	return 0
+}
+
+// upload encrypts the blocks of the write-back buffer with key and stores them. The
+// buffer must be locked.
+func (n *Node) upload(key []byte) syscall.Errno {
+	for _, indx := range slices.Sorted(maps.Keys(n.buf.blocks)) {
+		if err := n.writeBlock(key, indx, n.buf.blocks[indx]); err != nil {
+			logger.Errorf("upload block %d of inode %d: %s", indx, n.StableAttr().Ino, err)
+			return syscall.EIO
+		}
+	}
+	return 0
+}
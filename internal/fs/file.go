@@ -1,10 +1,15 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"os"
 	"syscall"
 
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -21,59 +26,263 @@ var _ = (fs.FileReleaser)((*File)(nil))
 var _ = (fs.FileFsyncer)((*File)(nil))
 
 func (f *File) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	ino := f.n.StableAttr().Ino
-	var keyCipher []byte
-	dataCipher, error := f.n.obj.Get(ino, off, &keyCipher)
-	if error != nil {
-		return nil, syscall.EIO
+	if f.n.locked.Load() {
+		return nil, syscall.EACCES
+	}
+	b := f.n.buf
+	b.Lock()
+	defer b.Unlock()
+	length := int64(max(b.saved, b.end))
+	// the length is read again when the read reaches its end, another client may have
+	// written after it
+	if off+int64(len(dest)) > length {
+		if errno := f.n.loadLength(ctx); errno != 0 {
+			return nil, errno
+		}
+		length = int64(max(b.saved, b.end))
+	}
+	if off >= length {
+		return fuse.ReadResultData(nil), 0
 	}
-	key, ok := f.n.enc.Decrypt(f.n.key, keyCipher)
-	if ok != nil {
-		return nil, syscall.EIO
+	size := int64(len(dest))
+	if off+size > length {
+		size = length - off
 	}
-	data, ok := f.n.enc.Decrypt(key, dataCipher)
-	if ok != nil {
-		return nil, syscall.EIO
+	bs := int64(f.n.blockSize)
+	data := dest[:size]
+	for done := int64(0); done < size; {
+		pos := off + done
+		indx := uint32(pos / bs)
+		boff := pos % bs
+		n := size - done
+		if n > bs-boff {
+			n = bs - boff
+		}
+		block, ok := b.blocks[indx]
+		if !ok {
+			var err error
+			block, err = f.n.readBlock(ctx, indx)
+			if err != nil && err != os.ErrNotExist {
+				return nil, syscall.EIO
+			}
+		}
+		// missing blocks and the part after the end of a short block are holes
+		var copied int
+		if int64(len(block)) > boff {
+			copied = copy(data[done:done+n], block[boff:])
+		}
+		clear(data[done+int64(copied) : done+n])
+		done += n
 	}
 	return fuse.ReadResultData(data), 0
 }
 
+// Write copies the data to the write-back buffer of the file, the blocks being
+// uploaded later.
 func (f *File) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
-	ino := f.n.StableAttr().Ino
-	err := f.n.meta.Write(ctx, ino, data, off)
-	if err != 0 {
-		return 0, err
+	if f.n.locked.Load() {
+		return 0, syscall.EACCES
 	}
-	size := int64(len(data))
-	key := f.n.key
-	contentKey := make([]byte, 32)
-	_, ok := rand.Read(contentKey)
-	if ok != nil {
-		return 0, syscall.EIO
+	if f.n.readOnly {
+		return 0, syscall.EROFS
 	}
-	contentKeyCipher, ok := f.n.enc.Encrypt(key, contentKey)
-	if ok != nil {
-		return 0, syscall.EIO
+	if f.n.sharedReadOnly {
+		return 0, syscall.EACCES
 	}
-	dataCipher, ok := f.n.enc.Encrypt(contentKey, data)
-	if ok != nil {
-		return 0, syscall.EIO
+	b := f.n.buf
+	b.Lock()
+	defer b.Unlock()
+	if b.size >= dirtyLimit {
+		if errno = f.n.flush(ctx); errno != 0 {
+			return 0, errno
+		}
 	}
-	error := f.n.obj.Put(ino, contentKeyCipher, dataCipher, size)
-	if error != nil {
-		return 0, syscall.EIO
+	bs := int64(f.n.blockSize)
+	for done := 0; done < len(data); {
+		pos := off + int64(done)
+		indx := uint32(pos / bs)
+		boff := int(pos % bs)
+		size := len(data) - done
+		if size > int(bs)-boff {
+			size = int(bs) - boff
+		}
+		block, ok := b.blocks[indx]
+		if !ok && (boff != 0 || size != int(bs)) {
+			// partial write, keep the rest of the block
+			var err error
+			block, err = f.n.readBlock(ctx, indx)
+			if err != nil && err != os.ErrNotExist {
+				return uint32(done), syscall.EIO
+			}
+		}
+		if len(block) < boff+size {
+			block = append(block, make([]byte, boff+size-len(block))...)
+		}
+		copy(block[boff:], data[done:done+size])
+		b.put(indx, block)
+		done += size
 	}
+	b.end = max(b.end, uint64(off)+uint64(len(data)))
+	b.dirty = true
 	return uint32(len(data)), 0
 }
 
-func (f *File) Flush(ctx context.Context) syscall.Errno {
+// loadLength reads the length of the file in meta. The buffer must be locked.
+func (n *Node) loadLength(ctx context.Context) syscall.Errno {
+	var attr meta.Attr
+	if errno := n.meta.GetAttr(ctx, Ino(n.StableAttr().Ino), &attr); errno != 0 {
+		return errno
+	}
+	n.buf.saved = attr.Length
 	return 0
 }
 
+// readBlock returns the decrypted content of the block indx of the file. The key of the
+// file is found again if it was rotated since the file was looked up.
+func (n *Node) readBlock(ctx context.Context, indx uint32) ([]byte, error) {
+	var keyCipher []byte
+	dataCipher, err := n.obj.Get(n.StableAttr().Ino, indx, &keyCipher)
+	if err != nil {
+		return nil, err
+	}
+	key := n.getKey()
+	block, err := n.openFileBlock(key, keyCipher, dataCipher)
+	if err != nil {
+		if fresh, errno := n.reloadKey(ctx); errno == 0 && !bytes.Equal(fresh, key) {
+			return n.openFileBlock(fresh, keyCipher, dataCipher)
+		}
+	}
+	return block, err
+}
+
+// openFileBlock decrypts a block of the file with key. A block not re-encrypted yet after
+// a rotation of the keys is decrypted with the previous key.
+func (n *Node) openFileBlock(key, keyCipher, dataCipher []byte) ([]byte, error) {
+	block, err := openBlock(n.enc, key, keyCipher, dataCipher)
+	if err != nil {
+		var rekey []byte
+		if n.meta.GetRekey(Ino(n.StableAttr().Ino), &rekey) != nil {
+			return nil, err
+		}
+		oldKey, err := n.enc.Decrypt(key, rekey)
+		if err != nil {
+			return nil, err
+		}
+		return openBlock(n.enc, oldKey, keyCipher, dataCipher)
+	}
+	return block, nil
+}
+
+// writeBlock encrypts the block with a new content key, itself encrypted with key, the
+// current key of the file, and stores it.
+func (n *Node) writeBlock(key []byte, indx uint32, block []byte) error {
+	keyCipher, dataCipher, err := sealBlock(n.enc, key, block)
+	if err != nil {
+		return err
+	}
+	return n.obj.Put(n.StableAttr().Ino, indx, keyCipher, dataCipher, int64(len(block)))
+}
+
+// openBlock decrypts a block with the key of its file.
+func openBlock(enc crypto.Crypto, key, keyCipher, dataCipher []byte) ([]byte, error) {
+	contentKey, err := enc.Decrypt(key, keyCipher)
+	if err != nil {
+		return nil, err
+	}
+	return enc.Decrypt(contentKey, dataCipher)
+}
+
+// sealBlock encrypts a block with a new content key, itself encrypted with the key of its file.
+func sealBlock(enc crypto.Crypto, key, block []byte) (keyCipher, dataCipher []byte, err error) {
+	contentKey := make([]byte, 32)
+	if _, err = rand.Read(contentKey); err != nil {
+		return nil, nil, err
+	}
+	if keyCipher, err = enc.Encrypt(key, contentKey); err != nil {
+		return nil, nil, err
+	}
+	if dataCipher, err = enc.Encrypt(contentKey, block); err != nil {
+		return nil, nil, err
+	}
+	return keyCipher, dataCipher, nil
+}
+
+// ReencryptBlocks encrypts again, with new content keys, the blocks of a file whose key
+// was rotated from oldKey to key. The blocks already encrypted with key are skipped, so
+// that an interrupted re-encryption can be resumed.
+func ReencryptBlocks(obj object.ObjectStorage, inode Ino, length uint64, blockSize int, key, oldKey []byte) error {
+	enc := &crypto.CryptoHelper{}
+	ino := uint64(inode)
+	for indx := uint32(0); uint64(indx)*uint64(blockSize) < length; indx++ {
+		var keyCipher []byte
+		dataCipher, err := obj.Get(ino, indx, &keyCipher)
+		if err == os.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = enc.Decrypt(key, keyCipher); err == nil {
+			continue // written since the rotation
+		}
+		block, err := openBlock(enc, oldKey, keyCipher, dataCipher)
+		if err != nil {
+			return err
+		}
+		if keyCipher, dataCipher, err = sealBlock(enc, key, block); err != nil {
+			return err
+		}
+		if err = obj.Put(ino, indx, keyCipher, dataCipher, int64(len(block))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate drops the blocks after length and re-encrypts the new last block.
+func (n *Node) truncate(ctx context.Context, length uint64) error {
+	bs := uint64(n.blockSize)
+	indx := uint32(length / bs)
+	if boff := int(length % bs); boff > 0 {
+		block, err := n.readBlock(ctx, indx)
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if len(block) > boff {
+			key, errno := n.reloadKey(ctx)
+			if errno != 0 {
+				return errno
+			}
+			if err = n.writeBlock(key, indx, block[:boff]); err != nil {
+				return err
+			}
+		}
+		indx++
+	}
+	return n.obj.Delete(n.StableAttr().Ino, indx)
+}
+
+// Flush uploads the writes when a descriptor of the file is closed, so that
+// close(2) reports their failure.
+func (f *File) Flush(ctx context.Context) syscall.Errno {
+	f.n.buf.Lock()
+	defer f.n.buf.Unlock()
+	return f.n.flush(ctx)
+}
+
 func (f *File) Release(ctx context.Context) syscall.Errno {
-	return 0
+	f.n.buf.Lock()
+	defer f.n.buf.Unlock()
+	errno := f.n.flush(ctx)
+	if errno != 0 {
+		logger.Warnf("writes to inode %d lost on release: %s", f.n.StableAttr().Ino, errno)
+	}
+	return errno
 }
 
+// Fsync returns once the writes are uploaded, or EIO if they could not be.
 func (f *File) Fsync(ctx context.Context, flags uint32) syscall.Errno {
-	return 0
+	f.n.buf.Lock()
+	defer f.n.buf.Unlock()
+	return f.n.flush(ctx)
 }
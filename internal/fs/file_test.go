@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mountTest mounts a new volume with blocks of blockSize bytes in a temporary directory,
+// as a user, and returns the mount point and its root. The test is skipped where FUSE is
+// not available.
+func mountTest(t *testing.T, blockSize int) (string, *Node) {
+	t.Helper()
+	dir := t.TempDir()
+	m := meta.RegisterMeta(filepath.Join(dir, "meta.db"), false)
+	format := &meta.Format{Name: "test", Storage: "file://" + filepath.Join(dir, "blocks"), BlockSize: blockSize}
+	if err := m.Init(format); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	t.Cleanup(m.Shutdown)
+	obj, err := object.CreateStorage(format.Storage, false)
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+	if err = m.CreateUser("alice", []byte("hash"), []byte("salt"), []byte("root"), []byte("priv"), []byte("pub")); err != nil {
+		t.Fatalf("create user: %s", err)
+	}
+	rootKey := make([]byte, 32)
+	if _, err = rand.Read(rootKey); err != nil {
+		t.Fatalf("root key: %s", err)
+	}
+	root := NewRootNode(m, obj, blockSize, nil, rootKey, "alice", false)
+	mp := filepath.Join(dir, "mnt")
+	if err = os.Mkdir(mp, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	server, err := fs.Mount(mp, root, &fs.Options{
+		MountOptions:   fuse.MountOptions{Name: "netsecfs", DirectMount: true},
+		RootStableAttr: &fs.StableAttr{Ino: uint64(meta.RootInode)},
+	})
+	if err != nil {
+		t.Skipf("FUSE is not available: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := server.Unmount(); err != nil {
+			t.Errorf("unmount: %s", err)
+		}
+	})
+	return mp, root
+}
+
+// checkContent checks the file has the content want.
+func checkContent(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %s", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %s: got %q, want %q", path, got, want)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	mp, _ := mountTest(t, 16)
+	path := filepath.Join(mp, "f")
+	data := bytes.Repeat([]byte("0123456789"), 4) // 2 blocks and a half
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	// in the middle of the second block, the third one is dropped
+	if err := os.Truncate(path, 20); err != nil {
+		t.Fatalf("shrink: %s", err)
+	}
+	checkContent(t, path, data[:20])
+	// the hole after the end is read as zeros, not as the data truncated
+	if err := os.Truncate(path, 50); err != nil {
+		t.Fatalf("grow: %s", err)
+	}
+	want := append(bytes.Clone(data[:20]), make([]byte, 30)...)
+	checkContent(t, path, want)
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("truncate to 0: %s", err)
+	}
+	checkContent(t, path, nil)
+}
+
+// writeAt writes data at off, uploaded at once when sync, else kept in the write-back buffer.
+func writeAt(t *testing.T, f *os.File, data []byte, off int64, sync bool) {
+	t.Helper()
+	if _, err := f.WriteAt(data, off); err != nil {
+		t.Fatalf("write %d bytes at %d: %s", len(data), off, err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			t.Fatalf("sync: %s", err)
+		}
+	}
+}
+
+func TestWriteBlocks(t *testing.T) {
+	mp, root := mountTest(t, 16)
+	path := filepath.Join(mp, "f")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer f.Close()
+	var want []byte
+	// the content the file should have after writing data at off
+	model := func(data []byte, off int) {
+		if len(want) < off+len(data) {
+			want = append(want, make([]byte, off+len(data)-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	for _, sync := range []bool{false, true} {
+		want = nil
+		if err := f.Truncate(0); err != nil {
+			t.Fatalf("truncate: %s", err)
+		}
+		for _, w := range []struct {
+			data string
+			off  int
+		}{
+			{"0123456789abcdef", 16},          // a whole block after a hole
+			{"ABCDEFGHIJKLMNOPQRSTUVWXYZ", 5}, // over the end of the hole and into the block
+			{"xy", 30},                        // inside a block
+			{"last", 60},                      // in the block after the end, past a hole
+		} {
+			writeAt(t, f, []byte(w.data), int64(w.off), sync)
+			model([]byte(w.data), w.off)
+		}
+		checkContent(t, path, want)
+		// reads across the boundaries of the blocks, made on the file as the kernel reads
+		// whole pages
+		file := &File{n: root.GetChild("f").Operations().(*Node)}
+		for _, rd := range [][2]int{{0, 64}, {10, 12}, {15, 2}, {14, 35}, {31, 33}, {50, 30}} {
+			off, size := rd[0], rd[1]
+			res, errno := file.Read(context.Background(), make([]byte, size), int64(off))
+			if errno != 0 {
+				t.Fatalf("read %d bytes at %d: %s", size, off, errno)
+			}
+			got, _ := res.Bytes(nil)
+			if end := min(off+size, len(want)); !bytes.Equal(got, want[off:end]) {
+				t.Errorf("read %d bytes at %d (sync %v): got %q, want %q", size, off, sync, got, want[off:end])
+			}
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	mp, _ := mountTest(t, 16)
+	path := filepath.Join(mp, "f")
+	var want []byte
+	for i, chunk := range []string{"first", " line crossing a block", "\n", "and a longer second line, over several blocks\n"} {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("open %d: %s", i, err)
+		}
+		if _, err = f.WriteString(chunk); err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+		// appended again while the first one is still buffered
+		if _, err = f.WriteString(chunk); err != nil {
+			t.Fatalf("append %d again: %s", i, err)
+		}
+		if err = f.Close(); err != nil {
+			t.Fatalf("close %d: %s", i, err)
+		}
+		want = append(want, chunk+chunk...)
+		checkContent(t, path, want)
+	}
+}
@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"sync"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// groups keeps the private keys of the groups of the user, to decrypt the keys of
+// the entries shared with them.
+type groups struct {
+	sync.Mutex
+	meta    meta.Meta
+	enc     crypto.Crypto
+	userId  uint32
+	privKey *rsa.PrivateKey
+	keys    map[uint32]*rsa.PrivateKey
+}
+
+func newGroups(m meta.Meta, userId uint32, privKey *rsa.PrivateKey) *groups {
+	return &groups{
+		meta:    m,
+		enc:     &crypto.CryptoHelper{},
+		userId:  userId,
+		privKey: privKey,
+		keys:    make(map[uint32]*rsa.PrivateKey),
+	}
+}
+
+// privateKey returns the private key of a group, from the secret of the group encrypted
+// for the user.
+func (g *groups) privateKey(group uint32) (*rsa.PrivateKey, error) {
+	g.Lock()
+	defer g.Unlock()
+	if key, ok := g.keys[group]; ok {
+		return key, nil
+	}
+	var keyCipher, secretCipher []byte
+	if err := g.meta.GetGroupKey(group, g.userId, &keyCipher, &secretCipher); err != nil {
+		return nil, err
+	}
+	secret, err := g.enc.DecryptRSA(g.privKey, secretCipher)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := g.enc.Decrypt(secret, keyCipher)
+	clear(secret)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	g.keys[group] = key
+	return key, nil
+}
+
+// forget drops the private key of a group, replaced after a member was removed.
+func (g *groups) forget(group uint32) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.keys, group)
+}
+
+// sharedKey decrypts the key of an entry of the shared directory, encrypted for the
+// user or for one of its groups.
+func (n *Node) sharedKey(e *meta.Entry) ([]byte, error) {
+	if e.Group == 0 {
+		return n.enc.DecryptRSA(n.privKey, e.Key)
+	}
+	key, err := n.groups.privateKey(e.Group)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey, err := n.enc.DecryptRSA(key, e.Key)
+	if err != nil {
+		// the key pair of the group may have been replaced since it was loaded
+		n.groups.forget(e.Group)
+		if key, err = n.groups.privateKey(e.Group); err != nil {
+			return nil, err
+		}
+		sharedKey, err = n.enc.DecryptRSA(key, e.Key)
+	}
+	return sharedKey, err
+}
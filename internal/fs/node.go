@@ -1,11 +1,14 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"io"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,33 +37,71 @@ type Ino = meta.Ino
 type Node struct {
 	fs.Inode
 
-	inoMap map[string]Ino
 	meta   meta.Meta
 	obj    object.ObjectStorage
 	enc    crypto.Crypto
+	owners *owners
+	groups *groups
+	shares *sharedKeys
 
-	privKey *rsa.PrivateKey
-	key     []byte
-	userId  uint32
+	blockSize int
+	privKey   *rsa.PrivateKey
+	key       []byte
+	userId    uint32
+	locked    *atomic.Bool // shared by all the nodes of the volume
+	readOnly  bool
+	buf       *writeBuffer
+	// keyMu guards key, replaced when the keys of the tree are rotated
+	keyMu sync.Mutex
+	// sharedReadOnly is set in the trees shared read-only with the user
+	sharedReadOnly bool
+	// hashed is set once the hashes of the names of the entries of the directory are checked
+	hashed atomic.Bool
 }
 
-func NewRootNode(meta meta.Meta, obj object.ObjectStorage, privateKey *rsa.PrivateKey, key []byte, username string) *Node {
+func NewRootNode(meta meta.Meta, obj object.ObjectStorage, blockSize int, privateKey *rsa.PrivateKey, key []byte, username string, readOnly bool) *Node {
 	var userId uint32
 	ok := meta.GetUserId(username, &userId)
 	if ok != nil {
 		return nil
 	}
+	// the changes of the mount are checked against the shares of the user
+	meta.SetUser(userId)
 	return &Node{
-		inoMap:  make(map[string]Ino),
-		meta:    meta,
-		obj:     obj,
-		enc:     &crypto.CryptoHelper{},
-		privKey: privateKey,
-		key:     key,
-		userId:  userId,
+		meta:      meta,
+		obj:       obj,
+		enc:       &crypto.CryptoHelper{},
+		owners:    newOwners(meta, userId),
+		groups:    newGroups(meta, userId, privateKey),
+		shares:    newSharedKeys(),
+		blockSize: blockSize,
+		privKey:   privateKey,
+		key:       key,
+		userId:    userId,
+		locked:    new(atomic.Bool),
+		readOnly:  readOnly,
+		buf:       new(writeBuffer),
 	}
 }
 
+// SetLocked refuses, or allows again, any access to the volume.
+func (n *Node) SetLocked(locked bool) {
+	n.locked.Store(locked)
+}
+
+// InvalidateEntry makes the kernel look up again the entry at path, relative to the root,
+// and so the entries below it, to find their keys again after they were rotated.
+func (n *Node) InvalidateEntry(path string) {
+	dir := n.EmbeddedInode()
+	names := strings.Split(path, "/")
+	for _, name := range names[:len(names)-1] {
+		if dir = dir.GetChild(name); dir == nil {
+			return // never looked up, nothing is cached
+		}
+	}
+	_ = dir.NotifyEntry(names[len(names)-1])
+}
+
 var _ = (fs.InodeEmbedder)((*Node)(nil))
 var _ = (fs.NodeLookuper)((*Node)(nil))
 var _ = (fs.NodeSetattrer)((*Node)(nil))
@@ -75,67 +116,233 @@ var _ = (fs.NodeMkdirer)((*Node)(nil))
 var _ = (fs.NodeRmdirer)((*Node)(nil))
 
 var _ = (fs.NodeUnlinker)((*Node)(nil))
+var _ = (fs.NodeLinker)((*Node)(nil))
+var _ = (fs.NodeRenamer)((*Node)(nil))
+
+var _ = (fs.NodeSymlinker)((*Node)(nil))
+var _ = (fs.NodeReadlinker)((*Node)(nil))
+
+var _ = (fs.NodeGetxattrer)((*Node)(nil))
+var _ = (fs.NodeSetxattrer)((*Node)(nil))
+var _ = (fs.NodeListxattrer)((*Node)(nil))
+var _ = (fs.NodeRemovexattrer)((*Node)(nil))
 
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.locked.Load() {
+		return nil, syscall.EACCES
+	}
 	if len(name) > maxName {
 		return nil, syscall.ENAMETOOLONG
 	}
-	var errno syscall.Errno
-	var err error
 	var attr = &meta.Attr{}
-	parent := Ino(n.StableAttr().Ino)
-	var key, keyDec []byte
-	ino, ok := n.inoMap[name]
-	if !ok {
-		return nil, syscall.ENOENT
-	}
-	if parent == meta.SharedInode {
-		errno = n.meta.GetSharedKey(ctx, n.userId, ino, &key)
+	var ino Ino
+	var key []byte
+	var errno syscall.Errno
+	readOnly := n.sharedReadOnly
+	if Ino(n.StableAttr().Ino) == meta.SharedInode {
+		ino, key, readOnly, errno = n.lookupShared(ctx, name, attr)
 	} else {
-		errno = n.meta.GetKey(ctx, ino, &key)
+		ino, key, errno = n.lookup(ctx, name, attr)
 	}
 	if errno != 0 {
 		return nil, errno
 	}
-	if parent == meta.SharedInode {
-		keyDec, err = n.enc.DecryptRSA(n.privKey, key)
-	} else {
-		keyDec, err = n.enc.Decrypt(n.key, key)
+	if readOnly {
+		attr.Mode &^= 0222
 	}
-	if err != nil {
-		return nil, syscall.EINVAL
-	}
-	errno = n.meta.Lookup(ctx, n.userId, parent, ino, attr)
-	if errno != 0 {
-		return nil, errno
-	}
-	ops := &Node{
-		inoMap:  n.inoMap,
-		meta:    n.meta,
-		obj:     n.obj,
-		enc:     n.enc,
-		privKey: n.privKey,
-		key:     keyDec,
-		userId:  n.userId,
+	if child, ok := n.child(name); ok && child.StableAttr().Ino == uint64(ino) {
+		// the length is not saved yet if the file is being written
+		attr.Length = child.buf.length(attr.Length)
+		// a known inode keeps its operations, with a key that changes when it is rotated
+		child.setKey(key)
 	}
 	entry := &meta.Entry{Inode: ino, Attr: attr}
-	attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
 	st := fs.StableAttr{
 		Mode: attr.SMode(),
 		Ino:  uint64(entry.Inode),
 		// Gen:  1,
 	}
+	ops := n.newChild(key)
+	ops.sharedReadOnly = readOnly
 	newNode := n.NewInode(ctx, ops, st)
 	return newNode, 0
 }
 
-func attrToStat(inode Ino, attr *meta.Attr, out *fuse.Attr) {
+// lookup finds the entry name of the directory and returns its inode and clear key.
+func (n *Node) lookup(ctx context.Context, name string, attr *meta.Attr) (Ino, []byte, syscall.Errno) {
+	parent := Ino(n.StableAttr().Ino)
+	if parent == meta.RootInode && name == "shared" {
+		return meta.SharedInode, nil, n.meta.GetAttr(ctx, meta.SharedInode, attr)
+	}
+	if parent == meta.SharedInode {
+		ino, key, _, errno := n.lookupShared(ctx, name, attr)
+		return ino, key, errno
+	}
+	var ino Ino
+	var keyCipher []byte
+	errno := n.meta.Lookup(ctx, n.userId, parent, n.hash(name), &ino, &keyCipher, attr)
+	if errno == syscall.ENOENT && !n.hashed.Load() {
+		return n.rehash(ctx, name, attr)
+	}
+	if errno != 0 {
+		return 0, nil, errno
+	}
+	key, err := n.enc.Decrypt(n.getKey(), keyCipher)
+	if err != nil {
+		return 0, nil, syscall.EIO
+	}
+	return ino, key, 0
+}
+
+// rehash saves the hashes of the names of the entries of the directory which have none,
+// being older than them, or a different one, and returns the entry name if it is one of them.
+func (n *Node) rehash(ctx context.Context, name string, attr *meta.Attr) (Ino, []byte, syscall.Errno) {
+	parent := Ino(n.StableAttr().Ino)
+	var entries []*meta.Entry
+	if errno := n.meta.Readdir(ctx, parent, n.userId, &entries); errno != 0 {
+		return 0, nil, errno
+	}
+	var found *meta.Entry
+	var foundKey []byte
+	saved := true
+	dirKey := n.getKey()
+	for _, e := range entries {
+		if len(e.Key) == 0 {
+			continue // the shared directory
+		}
+		key, err := n.enc.Decrypt(dirKey, e.Key)
+		if err != nil {
+			continue
+		}
+		plain, err := n.enc.Decrypt(key, e.Name)
+		if err != nil {
+			continue
+		}
+		if hash := n.hash(string(plain)); !bytes.Equal(hash, e.Hash) {
+			// a read-only mount finds such entries again on the next miss
+			if n.readOnly {
+				saved = false
+			} else if errno := n.meta.SetHash(ctx, parent, e.Name, hash); errno != 0 {
+				logger.Warnf("hash of an entry of inode %d not saved: %s", parent, errno)
+				saved = false
+			}
+		}
+		if string(plain) == name {
+			found, foundKey = e, key
+		}
+	}
+	n.hashed.Store(saved)
+	if found == nil {
+		return 0, nil, syscall.ENOENT
+	}
+	*attr = *found.Attr
+	return found.Inode, foundKey, 0
+}
+
+// lookupShared finds an entry of the shared directory and tells if it is shared read-only.
+// Its names are encrypted by the owners of the entries, who have no key in common with
+// the user, so they are all decrypted.
+func (n *Node) lookupShared(ctx context.Context, name string, attr *meta.Attr) (Ino, []byte, bool, syscall.Errno) {
+	shared, errno := n.sharedEntries(ctx)
+	if errno != 0 {
+		return 0, nil, false, errno
+	}
+	e, ok := findShared(shared, name)
+	if !ok {
+		return 0, nil, false, syscall.ENOENT
+	}
+	*attr = *e.Attr
+	return e.Inode, e.key, e.ReadOnly, 0
+}
+
+// getKey returns the key of the node, which changes when the keys of its tree are rotated.
+func (n *Node) getKey() []byte {
+	n.keyMu.Lock()
+	defer n.keyMu.Unlock()
+	return n.key
+}
+
+func (n *Node) setKey(key []byte) {
+	n.keyMu.Lock()
+	defer n.keyMu.Unlock()
+	n.key = key
+}
+
+// reloadKey finds again the key of the node from the root, and the ones of the directories
+// above it, as they may have been rotated by this mount or another one since they were
+// looked up. A node no longer in the tree keeps its key.
+func (n *Node) reloadKey(ctx context.Context) ([]byte, syscall.Errno) {
+	name, parent := n.Parent()
+	if parent == nil {
+		return n.getKey(), 0 // the root, whose key never changes, or a removed node
+	}
+	p := parent.Operations().(*Node)
+	if _, errno := p.reloadKey(ctx); errno != 0 {
+		return nil, errno
+	}
+	var attr meta.Attr
+	ino, key, errno := p.lookup(ctx, name, &attr)
+	if errno == syscall.ENOENT || errno == 0 && ino != Ino(n.StableAttr().Ino) {
+		return n.getKey(), 0
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	n.setKey(key)
+	return key, 0
+}
+
+// hash returns the digest of the name of an entry of this directory.
+func (n *Node) hash(name string) []byte {
+	return n.enc.Hash(n.getKey(), []byte(name))
+}
+
+// newChild returns the operations of an entry of this directory with its own key.
+func (n *Node) newChild(key []byte) *Node {
+	return &Node{
+		meta:      n.meta,
+		obj:       n.obj,
+		enc:       n.enc,
+		owners:    n.owners,
+		groups:    n.groups,
+		shares:    n.shares,
+		blockSize: n.blockSize,
+		privKey:   n.privKey,
+		key:       key,
+		userId:    n.userId,
+		locked:    n.locked,
+		readOnly:  n.readOnly,
+		buf:       new(writeBuffer),
+
+		sharedReadOnly: n.sharedReadOnly,
+	}
+}
+
+// child returns the operations of an entry of this directory already known by the kernel.
+func (n *Node) child(name string) (*Node, bool) {
+	ch := n.GetChild(name)
+	if ch == nil {
+		return nil, false
+	}
+	c, ok := ch.Operations().(*Node)
+	return c, ok
+}
+
+// reserved returns true if the name cannot be used for a new entry of the directory.
+func (n *Node) reserved(name string) bool {
+	parent := Ino(n.StableAttr().Ino)
+	return parent == meta.RootInode && name == "shared"
+}
+
+func (n *Node) attrToStat(inode Ino, attr *meta.Attr, out *fuse.Attr) {
 	if inode == meta.RootInode {
-		out.Uid = 0
-		out.Gid = 0
+		// every user has its own view of the root
+		out.Uid = n.owners.uid
+		out.Gid = n.owners.gid
 	} else {
-		out.Uid = uint32(os.Getuid())
-		out.Gid = uint32(os.Getgid())
+		out.Uid = n.owners.toLocal(attr.Uid)
+		out.Gid = attr.Gid
 	}
 	out.Ino = uint64(inode)
 	out.Mode = attr.SMode()
@@ -149,7 +356,7 @@ func attrToStat(inode Ino, attr *meta.Attr, out *fuse.Attr) {
 
 	var size, blocks uint64
 	switch attr.Typ {
-	case meta.TypeDirectory:
+	case meta.TypeDirectory, meta.TypeSymlink:
 		fallthrough
 	case meta.TypeFile:
 		size = attr.Length
@@ -161,13 +368,20 @@ func attrToStat(inode Ino, attr *meta.Attr, out *fuse.Attr) {
 }
 
 func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
 	var err syscall.Errno
 	var attr = &meta.Attr{}
 	ino := Ino(n.StableAttr().Ino)
 	err = n.meta.GetAttr(ctx, ino, attr)
 	if err == 0 {
+		attr.Length = n.buf.length(attr.Length)
+		if n.sharedReadOnly {
+			attr.Mode &^= 0222
+		}
 		entry := &meta.Entry{Inode: ino, Attr: attr}
-		attrToStat(entry.Inode, entry.Attr, &out.Attr)
+		n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
 	}
 	return err
 }
@@ -185,18 +399,106 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 }
 
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	var err syscall.Errno
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return syscall.EACCES
+	}
+	// the buffered writes are saved first, not to override the new attributes
+	n.buf.Lock()
+	defer n.buf.Unlock()
+	err := n.flush(ctx)
+	if err != 0 {
+		return err
+	}
 	var attr = &meta.Attr{}
 	ino := Ino(n.StableAttr().Ino)
-	err = n.meta.SetAttr(ctx, ino, in, attr)
-	if err == 0 {
-		entry := &meta.Entry{Inode: ino, Attr: attr}
-		attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	var set uint16
+	if mode, ok := in.GetMode(); ok {
+		set |= meta.SetAttrMode
+		attr.Mode = uint16(mode)
+	}
+	if uid, ok := in.GetUID(); ok {
+		owner, errno := n.owners.fromLocal(uid)
+		if errno != 0 {
+			return errno
+		}
+		set |= meta.SetAttrUID
+		attr.Uid = owner
+	}
+	if gid, ok := in.GetGID(); ok {
+		set |= meta.SetAttrGID
+		attr.Gid = gid
+	}
+	// the current time can be set by any writer, another one only by the owner
+	if atime, ok := in.GetATime(); ok && in.Valid&fuse.FATTR_ATIME_NOW != 0 {
+		set |= meta.SetAttrAtimeNow
+	} else if ok {
+		set |= meta.SetAttrAtime
+		attr.Atime = atime.Unix()
+		attr.Atimensec = uint32(atime.Nanosecond())
+	}
+	if mtime, ok := in.GetMTime(); ok && in.Valid&fuse.FATTR_MTIME_NOW != 0 {
+		set |= meta.SetAttrMtimeNow
+	} else if ok {
+		set |= meta.SetAttrMtime
+		attr.Mtime = mtime.Unix()
+		attr.Mtimensec = uint32(mtime.Nanosecond())
+	}
+	size, shrink := in.GetSize()
+	if shrink {
+		set |= meta.SetAttrSize
+		attr.Length = size
+		var cur meta.Attr
+		if err = n.meta.GetAttr(ctx, ino, &cur); err != 0 {
+			return err
+		}
+		if cur.Typ == meta.TypeDirectory {
+			return syscall.EISDIR
+		}
+		shrink = size < cur.Length
 	}
-	return err
+	err = n.meta.SetAttr(ctx, ino, set, attr)
+	if err != 0 {
+		return err
+	}
+	if set&meta.SetAttrSize != 0 {
+		n.buf.saved = size
+	}
+	// the blocks are dropped once the new length is saved, a refused truncate keeps them
+	if shrink {
+		if err := n.truncate(ctx, size); err != nil {
+			logger.Errorf("truncate blocks of inode %d: %s", ino, err)
+			return syscall.EIO
+		}
+	}
+	entry := &meta.Entry{Inode: ino, Attr: attr}
+	n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	return 0
 }
 
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.locked.Load() {
+		return nil, 0, syscall.EACCES
+	}
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		if n.readOnly {
+			return nil, 0, syscall.EROFS
+		}
+		if n.sharedReadOnly {
+			return nil, 0, syscall.EACCES
+		}
+	}
+	n.buf.Lock()
+	errno = n.loadLength(ctx)
+	n.buf.Unlock()
+	if errno != 0 {
+		return nil, 0, errno
+	}
 	fh = &File{
 		n: n,
 	}
@@ -204,16 +506,24 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 }
 
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.locked.Load() {
+		return nil, nil, 0, syscall.EACCES
+	}
+	if n.readOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return nil, nil, 0, syscall.EACCES
+	}
 	if len(name) > maxName {
 		return nil, nil, 0, syscall.ENAMETOOLONG
 	}
-	if n.GetChild(name) != nil {
+	if n.reserved(name) {
 		return nil, nil, 0, syscall.EEXIST
 	}
-	attr := &meta.Attr{}
+	attr := &meta.Attr{Gid: n.owners.callerGid(ctx)}
 	parent := Ino(n.StableAttr().Ino)
 	var ino Ino
-	n.meta.GetNextInode(ctx, &ino)
 	key := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		return nil, nil, 0, fs.ToErrno(err)
@@ -222,29 +532,17 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 	if ok != nil {
 		return nil, nil, 0, syscall.EINVAL
 	}
-	keyCipher, ok := n.enc.Encrypt(n.key, key)
+	keyCipher, ok := n.enc.Encrypt(n.getKey(), key)
 	if ok != nil {
 		return nil, nil, 0, syscall.EINVAL
 	}
-	err := n.meta.Mknod(ctx, parent, meta.TypeFile, mode, n.userId, &ino, cipher, keyCipher, attr)
+	err := n.meta.Mknod(ctx, parent, meta.TypeFile, mode, n.userId, &ino, cipher, n.hash(name), keyCipher, attr)
 	if err != 0 {
 		return nil, nil, 0, err
 	}
-	_, exist := n.inoMap[name]
-	if !exist {
-		n.inoMap[name] = ino
-	}
 	entry := &meta.Entry{Inode: ino, Attr: attr}
-	attrToStat(entry.Inode, entry.Attr, &out.Attr)
-	ops := &Node{
-		inoMap:  n.inoMap,
-		meta:    n.meta,
-		obj:     n.obj,
-		enc:     n.enc,
-		privKey: n.privKey,
-		key:     key,
-		userId:  n.userId,
-	}
+	n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	ops := n.newChild(key)
 	st := fs.StableAttr{
 		Mode: attr.SMode(),
 		Ino:  uint64(entry.Inode),
@@ -260,6 +558,9 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 }
 
 func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if n.locked.Load() {
+		return nil, syscall.EACCES
+	}
 	var attr meta.Attr
 	var entries []*meta.Entry
 	result := make([]fuse.DirEntry, 0)
@@ -282,6 +583,9 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		Name:  []byte(".."),
 		Attr:  &meta.Attr{Typ: meta.TypeDirectory},
 	})
+	if inode == meta.SharedInode {
+		return n.readdirShared(ctx, entries)
+	}
 	errno := n.meta.Readdir(ctx, inode, n.userId, &entries)
 	if errno != 0 {
 		return nil, errno
@@ -290,11 +594,7 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	var name, key []byte
 	var ok error
 	for _, e := range entries {
-		if inode == meta.SharedInode {
-			key, ok = n.enc.DecryptRSA(n.privKey, e.Key)
-		} else {
-			key, ok = n.enc.Decrypt(n.key, e.Key)
-		}
+		key, ok = n.enc.Decrypt(n.getKey(), e.Key)
 		if ok != nil {
 			return nil, syscall.EINVAL
 		}
@@ -302,11 +602,6 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		if ok != nil {
 			return nil, syscall.EINVAL
 		}
-		if string(name) != "." && string(name) != ".." {
-			if n.inoMap != nil {
-				n.inoMap[string(name)] = e.Inode
-			}
-		}
 		de.Ino = uint64(e.Inode)
 		de.Name = string(name)
 		de.Mode = e.Attr.SMode()
@@ -316,16 +611,24 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 }
 
 func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	if n.locked.Load() {
+		return nil, syscall.EACCES
+	}
+	if n.readOnly {
+		return nil, syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return nil, syscall.EACCES
+	}
 	if len(name) > maxName {
 		return nil, syscall.ENAMETOOLONG
 	}
-	if n.GetChild(name) != nil {
+	if n.reserved(name) {
 		return nil, syscall.EEXIST
 	}
-	attr := &meta.Attr{}
+	attr := &meta.Attr{Gid: n.owners.callerGid(ctx)}
 	parent := Ino(n.StableAttr().Ino)
 	var ino Ino
-	n.meta.GetNextInode(ctx, &ino)
 	key := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		return nil, fs.ToErrno(err)
@@ -334,25 +637,17 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	if ok != nil {
 		return nil, syscall.EINVAL
 	}
-	keyCipher, ok := n.enc.Encrypt(n.key, key)
+	keyCipher, ok := n.enc.Encrypt(n.getKey(), key)
 	if ok != nil {
 		return nil, syscall.EINVAL
 	}
-	err := n.meta.Mknod(ctx, parent, meta.TypeDirectory, mode, n.userId, &ino, cipher, keyCipher, attr)
+	err := n.meta.Mknod(ctx, parent, meta.TypeDirectory, mode, n.userId, &ino, cipher, n.hash(name), keyCipher, attr)
 	if err != 0 {
 		return nil, err
 	}
 	entry := &meta.Entry{Inode: ino, Attr: attr}
-	attrToStat(entry.Inode, entry.Attr, &out.Attr)
-	ops := &Node{
-		inoMap:  make(map[string]Ino),
-		meta:    n.meta,
-		obj:     n.obj,
-		enc:     n.enc,
-		privKey: n.privKey,
-		key:     key,
-		userId:  n.userId,
-	}
+	n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	ops := n.newChild(key)
 	st := fs.StableAttr{
 		Mode: attr.SMode(),
 		Ino:  uint64(entry.Inode),
@@ -363,7 +658,82 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	return node, 0
 }
 
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	if n.locked.Load() {
+		return nil, syscall.EACCES
+	}
+	if n.readOnly {
+		return nil, syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return nil, syscall.EACCES
+	}
+	if len(name) > maxName || len(target) > meta.MaxSymlink {
+		return nil, syscall.ENAMETOOLONG
+	}
+	if n.reserved(name) {
+		return nil, syscall.EEXIST
+	}
+	attr := &meta.Attr{Gid: n.owners.callerGid(ctx), Length: uint64(len(target))}
+	parent := Ino(n.StableAttr().Ino)
+	var ino Ino
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	cipher, ok := n.enc.Encrypt(key, []byte(name))
+	if ok != nil {
+		return nil, syscall.EINVAL
+	}
+	keyCipher, ok := n.enc.Encrypt(n.getKey(), key)
+	if ok != nil {
+		return nil, syscall.EINVAL
+	}
+	// the target is encrypted with the key of the symlink itself
+	targetCipher, ok := n.enc.Encrypt(key, []byte(target))
+	if ok != nil {
+		return nil, syscall.EINVAL
+	}
+	err := n.meta.Symlink(ctx, parent, n.userId, &ino, cipher, n.hash(name), keyCipher, targetCipher, attr)
+	if err != 0 {
+		return nil, err
+	}
+	entry := &meta.Entry{Inode: ino, Attr: attr}
+	n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	ops := n.newChild(key)
+	st := fs.StableAttr{
+		Mode: attr.SMode(),
+		Ino:  uint64(entry.Inode),
+	}
+	return n.NewInode(ctx, ops, st), 0
+}
+
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.locked.Load() {
+		return nil, syscall.EACCES
+	}
+	var targetCipher []byte
+	ino := Ino(n.StableAttr().Ino)
+	if err := n.meta.ReadLink(ctx, ino, &targetCipher); err != 0 {
+		return nil, err
+	}
+	target, err := n.enc.Decrypt(n.getKey(), targetCipher)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return target, 0
+}
+
 func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return syscall.EACCES
+	}
 	if len(name) > maxName {
 		return syscall.ENAMETOOLONG
 	}
@@ -376,11 +746,14 @@ func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 	if name == ".." {
 		return syscall.ENOTEMPTY
 	}
-	ino := n.inoMap[name]
+	var attr meta.Attr
+	ino, _, errno := n.lookup(ctx, name, &attr)
+	if errno != 0 {
+		return errno
+	}
 	parent := Ino(n.StableAttr().Ino)
 	// node := n.GetChild(name)
-	err := n.meta.Rmdir(ctx, parent, ino)
-	delete(n.inoMap, name)
+	err := n.meta.Rmdir(ctx, parent, ino, n.hash(name))
 	// seems to be done by default
 	/*if err == 0 {
 		n.RmChild(name)
@@ -389,17 +762,260 @@ func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 }
 
 func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return syscall.EACCES
+	}
 	if len(name) > maxName {
 		return syscall.ENAMETOOLONG
 	}
-	child := n.GetChild(name)
-	ino := n.inoMap[name]
+	var attr meta.Attr
+	ino, _, errno := n.lookup(ctx, name, &attr)
+	if errno != 0 {
+		return errno
+	}
 	parent := Ino(n.StableAttr().Ino)
-	err := n.meta.Unlink(ctx, parent, ino)
-	delete(n.inoMap, name)
+	err := n.meta.Unlink(ctx, parent, ino, n.hash(name), &attr)
 	if err != 0 {
 		return err
 	}
-	errno := n.obj.Delete(child.StableAttr().Ino, "")
-	return fs.ToErrno(errno)
+	if attr.Nlink > 0 {
+		return 0
+	}
+	if child, ok := n.child(name); ok {
+		child.buf.discard()
+	}
+	return fs.ToErrno(n.obj.Delete(uint64(ino), 0))
+}
+
+func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	if n.locked.Load() {
+		return nil, syscall.EACCES
+	}
+	if n.readOnly {
+		return nil, syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return nil, syscall.EACCES
+	}
+	if len(name) > maxName {
+		return nil, syscall.ENAMETOOLONG
+	}
+	if n.reserved(name) {
+		return nil, syscall.EEXIST
+	}
+	src, ok := target.(*Node)
+	if !ok {
+		return nil, syscall.EXDEV
+	}
+	if src.sharedReadOnly {
+		return nil, syscall.EACCES
+	}
+	attr := &meta.Attr{}
+	parent := Ino(n.StableAttr().Ino)
+	ino := Ino(src.StableAttr().Ino)
+	// every link has its own name and a copy of the node key wrapped with the key of its directory
+	cipher, err := n.enc.Encrypt(src.getKey(), []byte(name))
+	if err != nil {
+		return nil, syscall.EINVAL
+	}
+	keyCipher, err := n.enc.Encrypt(n.getKey(), src.getKey())
+	if err != nil {
+		return nil, syscall.EINVAL
+	}
+	errno = n.meta.Link(ctx, ino, parent, cipher, n.hash(name), keyCipher, attr)
+	if errno != 0 {
+		return nil, errno
+	}
+	entry := &meta.Entry{Inode: ino, Attr: attr}
+	n.attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	return src.EmbeddedInode(), 0
+}
+
+func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if len(name) > maxName || len(newName) > maxName {
+		return syscall.ENAMETOOLONG
+	}
+	dst, ok := newParent.(*Node)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if n.sharedReadOnly || dst.sharedReadOnly {
+		return syscall.EACCES
+	}
+	parent := Ino(n.StableAttr().Ino)
+	dstParent := Ino(dst.StableAttr().Ino)
+	if (parent == meta.RootInode && name == "shared") || (dstParent == meta.RootInode && newName == "shared") {
+		return syscall.EPERM
+	}
+	if parent == meta.SharedInode && dstParent == meta.SharedInode {
+		return n.renameShared(ctx, name, newName, flags)
+	}
+	var attr meta.Attr
+	ino, key, errno := n.lookup(ctx, name, &attr)
+	if errno != 0 {
+		return errno
+	}
+	// the name stays encrypted with the key of the entry, which is wrapped with the key of its new parent
+	nameCipher, err := n.enc.Encrypt(key, []byte(newName))
+	if err != nil {
+		return syscall.EINVAL
+	}
+	keyCipher, err := n.enc.Encrypt(dst.getKey(), key)
+	if err != nil {
+		return syscall.EINVAL
+	}
+	var dstNameCipher, dstKeyCipher []byte
+	dstIno, dstKey, errno := dst.lookup(ctx, newName, &attr)
+	switch {
+	case errno == syscall.ENOENT:
+		dstIno = 0
+	case errno != 0:
+		return errno
+	case flags&meta.RenameNoReplace != 0:
+		return syscall.EEXIST
+	case dstIno == ino && flags&meta.RenameExchange == 0:
+		return 0 // both names are links to the same node
+	case flags&meta.RenameExchange != 0:
+		dstNameCipher, err = n.enc.Encrypt(dstKey, []byte(name))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		dstKeyCipher, err = n.enc.Encrypt(n.getKey(), dstKey)
+		if err != nil {
+			return syscall.EINVAL
+		}
+	}
+	errno = n.meta.Rename(ctx, parent, ino, n.hash(name), dstParent, dstIno, flags, nameCipher, dst.hash(newName), keyCipher, dstNameCipher, dstKeyCipher, &attr)
+	if errno != 0 {
+		return errno
+	}
+	if flags&meta.RenameExchange == 0 && dstIno != 0 && attr.Typ == meta.TypeFile && attr.Nlink == 0 {
+		if child, ok := dst.child(newName); ok {
+			child.buf.discard()
+		}
+		return fs.ToErrno(n.obj.Delete(uint64(dstIno), 0))
+	}
+	return 0
+}
+
+func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if n.locked.Load() {
+		return 0, syscall.EACCES
+	}
+	if len(attr) > meta.MaxXattrName {
+		return 0, syscall.ERANGE
+	}
+	if len(attr) == 0 {
+		return 0, syscall.EINVAL
+	}
+	ino := Ino(n.StableAttr().Ino)
+	// the name is found by its hash, both name and value are encrypted with the key of the node
+	key := n.getKey()
+	var cipher []byte
+	errno := n.meta.GetXattr(ctx, ino, n.enc.Hash(key, []byte(attr)), &cipher)
+	if errno != 0 {
+		return 0, errno
+	}
+	value, err := n.enc.Decrypt(key, cipher)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return syscall.EACCES
+	}
+	if len(attr) > meta.MaxXattrName {
+		return syscall.ERANGE
+	}
+	if len(attr) == 0 {
+		return syscall.EINVAL
+	}
+	if len(data) > meta.MaxXattrValue {
+		return syscall.E2BIG
+	}
+	ino := Ino(n.StableAttr().Ino)
+	key := n.getKey()
+	name, err := n.enc.Encrypt(key, []byte(attr))
+	if err != nil {
+		return syscall.EINVAL
+	}
+	value, err := n.enc.Encrypt(key, data)
+	if err != nil {
+		return syscall.EINVAL
+	}
+	return n.meta.SetXattr(ctx, ino, n.enc.Hash(key, []byte(attr)), name, value, flags)
+}
+
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if n.locked.Load() {
+		return 0, syscall.EACCES
+	}
+	ino := Ino(n.StableAttr().Ino)
+	var names [][]byte
+	if errno := n.meta.ListXattr(ctx, ino, &names); errno != 0 {
+		return 0, errno
+	}
+	key := n.getKey()
+	var list []byte
+	for _, cipher := range names {
+		name, err := n.enc.Decrypt(key, cipher)
+		if err != nil {
+			// set with the key of another user on the root by older versions
+			logger.Warnf("attribute of inode %d skipped, it cannot be decrypted", ino)
+			continue
+		}
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+	if len(list) > meta.MaxXattrValue {
+		return 0, syscall.E2BIG
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
+
+func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if n.locked.Load() {
+		return syscall.EACCES
+	}
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if n.sharedReadOnly {
+		return syscall.EACCES
+	}
+	if len(attr) > meta.MaxXattrName {
+		return syscall.ERANGE
+	}
+	if len(attr) == 0 {
+		return syscall.EINVAL
+	}
+	ino := Ino(n.StableAttr().Ino)
+	return n.meta.RemoveXattr(ctx, ino, n.enc.Hash(n.getKey(), []byte(attr)))
 }
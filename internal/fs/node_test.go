@@ -0,0 +1,31 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+func TestRenameNoReplace(t *testing.T) {
+	mp, root := mountTest(t, 16)
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(mp, name), []byte(name), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	if err := os.Link(filepath.Join(mp, "a"), filepath.Join(mp, "c")); err != nil {
+		t.Fatalf("link a: %s", err)
+	}
+	// called on the node, the kernel refusing it before when it knows the entry
+	for _, dst := range []string{"b", "c"} {
+		if errno := root.Rename(context.Background(), "a", root, dst, meta.RenameNoReplace); errno != syscall.EEXIST {
+			t.Errorf("rename a to %s without replacing it: got %v, want EEXIST", dst, errno)
+		}
+	}
+	checkContent(t, filepath.Join(mp, "a"), []byte("a"))
+	checkContent(t, filepath.Join(mp, "b"), []byte("b"))
+}
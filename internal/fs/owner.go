@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const nobody = 65534
+
+// owners maps the users of the volume to local uids. The user who mounted the
+// volume is the local user running the mount, the others are found by name.
+type owners struct {
+	sync.Mutex
+	meta   meta.Meta
+	userId uint32
+	uid    uint32
+	gid    uint32
+	local  map[uint32]uint32
+}
+
+func newOwners(m meta.Meta, userId uint32) *owners {
+	return &owners{
+		meta:   m,
+		userId: userId,
+		uid:    uint32(os.Getuid()),
+		gid:    uint32(os.Getgid()),
+		local:  make(map[uint32]uint32),
+	}
+}
+
+// toLocal returns the local uid of the given user of the volume.
+func (o *owners) toLocal(owner uint32) uint32 {
+	if owner == o.userId {
+		return o.uid
+	}
+	if owner == 0 {
+		return 0 // created with the volume
+	}
+	o.Lock()
+	defer o.Unlock()
+	if uid, ok := o.local[owner]; ok {
+		return uid
+	}
+	uid := uint32(nobody)
+	var username string
+	if err := o.meta.GetUsername(owner, &username); err == nil {
+		if u, err := user.Lookup(username); err == nil {
+			if id, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
+				uid = uint32(id)
+			}
+		}
+	}
+	o.local[owner] = uid
+	return uid
+}
+
+// fromLocal returns the user of the volume with the same name as the local user uid.
+func (o *owners) fromLocal(uid uint32) (uint32, syscall.Errno) {
+	if uid == o.uid {
+		return o.userId, 0
+	}
+	o.Lock()
+	defer o.Unlock()
+	for owner, id := range o.local {
+		if id == uid && id != nobody {
+			return owner, 0
+		}
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return 0, syscall.EINVAL
+	}
+	var owner uint32
+	if err := o.meta.GetUserId(u.Username, &owner); err != nil {
+		return 0, syscall.EINVAL
+	}
+	o.local[owner] = uid
+	return owner, 0
+}
+
+// callerGid returns the group of the process doing the request.
+func (o *owners) callerGid(ctx context.Context) uint32 {
+	if caller, ok := fuse.FromContext(ctx); ok {
+		return caller.Gid
+	}
+	return o.gid
+}
@@ -0,0 +1,183 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// sharedEntry is an entry of the shared directory, with its clear key and the name it
+// appears under.
+type sharedEntry struct {
+	*meta.Entry
+	key []byte
+	// name is the name given by the owner of the entry, or the alias given by the user
+	name  string
+	alias bool
+}
+
+// sharedKeys keeps the clear keys of the entries of the shared directory by their keys
+// encrypted with RSA, not to decrypt all of them again on every lookup.
+type sharedKeys struct {
+	sync.Mutex
+	keys map[string][]byte
+}
+
+func newSharedKeys() *sharedKeys {
+	return &sharedKeys{keys: make(map[string][]byte)}
+}
+
+// sharedEntries returns the entries of the shared directory of the user, with unique names.
+func (n *Node) sharedEntries(ctx context.Context) ([]*sharedEntry, syscall.Errno) {
+	c := n.shares
+	c.Lock()
+	defer c.Unlock()
+	// the keys of the entries no longer shared are forgotten
+	seen := make(map[string][]byte)
+	shared, errno := readShared(ctx, n.meta, n.enc, n.userId, func(e *meta.Entry) ([]byte, error) {
+		key, ok := c.keys[string(e.Key)]
+		if !ok {
+			var err error
+			if key, err = n.sharedKey(e); err != nil {
+				return nil, err
+			}
+		}
+		seen[string(e.Key)] = key
+		return key, nil
+	})
+	if errno == 0 {
+		c.keys = seen
+	}
+	return shared, errno
+}
+
+func readShared(ctx context.Context, m meta.Meta, enc crypto.Crypto, userId uint32, sharedKey func(*meta.Entry) ([]byte, error)) ([]*sharedEntry, syscall.Errno) {
+	var entries []*meta.Entry
+	if errno := m.Readdir(ctx, meta.SharedInode, userId, &entries); errno != 0 {
+		return nil, errno
+	}
+	shared := make([]*sharedEntry, 0, len(entries))
+	for _, e := range entries {
+		key, err := sharedKey(e)
+		if err != nil {
+			continue
+		}
+		name, err := enc.Decrypt(key, e.Name)
+		if err != nil {
+			continue
+		}
+		se := &sharedEntry{Entry: e, key: key, name: string(name)}
+		if e.Alias != nil {
+			// an alias encrypted by a key rotated since is ignored
+			if alias, err := enc.Decrypt(key, e.Alias); err == nil {
+				se.name = string(alias)
+				se.alias = true
+			}
+		}
+		shared = append(shared, se)
+	}
+	uniqueNames(shared)
+	return shared, 0
+}
+
+// uniqueNames renames the entries of the shared directory with the same name, shared by
+// different users or twice by the same one. The names given by the owners get the name of
+// the owner as suffix, as name@owner, and a number if they still collide.
+func uniqueNames(shared []*sharedEntry) {
+	count := make(map[string]int)
+	for _, e := range shared {
+		count[e.name]++
+	}
+	for _, e := range shared {
+		if count[e.name] > 1 && !e.alias {
+			e.name += "@" + e.Owner
+		}
+	}
+	used := make(map[string]bool)
+	for _, e := range shared {
+		name := e.name
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s~%d", e.name, i)
+		}
+		used[name] = true
+		e.name = name
+	}
+}
+
+// readdirShared lists the shared directory after its entries . and ..
+func (n *Node) readdirShared(ctx context.Context, dots []*meta.Entry) (fs.DirStream, syscall.Errno) {
+	shared, errno := n.sharedEntries(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	result := make([]fuse.DirEntry, 0, len(dots)+len(shared))
+	for _, e := range dots {
+		result = append(result, fuse.DirEntry{Ino: uint64(e.Inode), Name: string(e.Name), Mode: e.Attr.SMode()})
+	}
+	for _, e := range shared {
+		result = append(result, fuse.DirEntry{Ino: uint64(e.Inode), Name: e.name, Mode: e.Attr.SMode()})
+	}
+	return fs.NewListDirStream(result), 0
+}
+
+// findShared returns the entry of the shared directory with the given name.
+func findShared(shared []*sharedEntry, name string) (*sharedEntry, bool) {
+	for _, e := range shared {
+		if e.name == name {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// renameShared gives an alias to an entry of the shared directory, seen only by the user.
+// The name given by the owner of the entry removes the alias.
+func (n *Node) renameShared(ctx context.Context, name, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.EINVAL
+	}
+	shared, errno := n.sharedEntries(ctx)
+	if errno != 0 {
+		return errno
+	}
+	e, ok := findShared(shared, name)
+	if !ok {
+		return syscall.ENOENT
+	}
+	if other, ok := findShared(shared, newName); ok {
+		if other == e {
+			return 0
+		}
+		return syscall.EEXIST
+	}
+	var aliasCipher []byte
+	if original, err := n.enc.Decrypt(e.key, e.Name); err != nil || string(original) != newName {
+		if aliasCipher, err = n.enc.Encrypt(e.key, []byte(newName)); err != nil {
+			return syscall.EINVAL
+		}
+	}
+	if err := n.meta.SetAlias(n.userId, e.Inode, aliasCipher); err != nil {
+		return fs.ToErrno(err)
+	}
+	return 0
+}
+
+// SharedNames returns the names under which the entries of the shared directory of the
+// user appear, by inode, sharedKey decrypting their keys.
+func SharedNames(m meta.Meta, userId uint32, sharedKey func(*meta.Entry) ([]byte, error)) (map[Ino]string, error) {
+	shared, errno := readShared(context.Background(), m, &crypto.CryptoHelper{}, userId, sharedKey)
+	if errno != 0 {
+		return nil, errno
+	}
+	names := make(map[Ino]string, len(shared))
+	for _, e := range shared {
+		names[e.Inode] = e.name
+	}
+	return names, nil
+}
@@ -0,0 +1,22 @@
+package utils
+
+import "testing"
+
+func TestStripUserinfo(t *testing.T) {
+	cases := []struct {
+		addr, want string
+	}{
+		{"/var/lib/nsfs/data.db", "/var/lib/nsfs/data.db"},
+		{"file:///var/lib/nsfs", "file:///var/lib/nsfs"},
+		{"s3://access:secret@minio.local:9000/nsfs?secure=false", "s3://minio.local:9000/nsfs?secure=false"},
+		{"s3://minio.local:9000/nsfs", "s3://minio.local:9000/nsfs"},
+		{"postgres://user:p@ss@host:5432/nsfs?sslmode=disable", "postgres://host:5432/nsfs?sslmode=disable"},
+		{"mysql://user:pass@(host:3306)/nsfs", "mysql://(host:3306)/nsfs"},
+		{"user:pass@tcp(host:3306)/nsfs", "tcp(host:3306)/nsfs"},
+	}
+	for _, c := range cases {
+		if got := StripUserinfo(c.addr); got != c.want {
+			t.Errorf("StripUserinfo(%q) = %q, want %q", c.addr, got, c.want)
+		}
+	}
+}